@@ -32,11 +32,18 @@ func getURL(domain, path string) string {
 	return "https://" + domain + "/" + path
 }
 
-// getImagesFromHTML spawns image workers for all the icons referenced within a HTML page.
+// getImagesFromHTML spawns image workers for all the icons referenced within a HTML page, and
+// returns the URLs of the manifests it links to, to be processed with processManifest.
 //
-// - n: The HTML node to search for image-related attributes.
-// - url: The base URL to resolve relative image URLs.
-func getImagesFromHTML(node *html.Node, domain string, workers *imageWorkers) {
+// - node: The HTML node to search for image-related attributes.
+// - domain: The domain used to resolve relative image URLs.
+// - pageURL: The URL of the page, recorded as the referrer of the icons.
+// - workers: The image workers the icons are spawned on.
+func getImagesFromHTML(
+	node *html.Node,
+	domain, pageURL string,
+	workers *imageWorkers,
+) (manifests []string) {
 	if node.Type == html.ElementNode && node.Data == "head" {
 		// Process the "head" node elements
 		for c := node.FirstChild; c != nil; c = c.NextSibling {
@@ -45,12 +52,18 @@ func getImagesFromHTML(node *html.Node, domain string, workers *imageWorkers) {
 				if rel == "manifest" {
 					// Parse link rel="manifest"
 					if href := getNodeAttr(c, "href"); href != "" {
-						processManifest(domain, getURL(domain, href), workers)
+						manifests = append(manifests, getURL(domain, href))
 					}
 				} else if contains(iconRelValues, rel) {
 					// Process any icons links
 					if href := getNodeAttr(c, "href"); href != "" {
-						workers.spawn(getURL(domain, href))
+						workers.spawn(getURL(domain, href), Provenance{
+							Kind:      SourceLink,
+							Attribute: rel,
+							Sizes:     getNodeAttr(c, "sizes"),
+							Type:      getNodeAttr(c, "type"),
+							Referrer:  pageURL,
+						})
 					}
 				}
 			}
@@ -59,16 +72,21 @@ func getImagesFromHTML(node *html.Node, domain string, workers *imageWorkers) {
 				if itemprop == "image" {
 					// Process any icons links
 					if href := getNodeAttr(c, "content"); href != "" {
-						workers.spawn(getURL(domain, href))
+						workers.spawn(getURL(domain, href), Provenance{
+							Kind:      SourceMeta,
+							Attribute: itemprop,
+							Referrer:  pageURL,
+						})
 					}
 				}
 			}
 		}
-		return
+		return manifests
 	}
 	for c := node.FirstChild; c != nil; c = c.NextSibling {
-		getImagesFromHTML(c, domain, workers)
+		manifests = append(manifests, getImagesFromHTML(c, domain, pageURL, workers)...)
 	}
+	return manifests
 }
 
 // contains checks if the target string is present in the provided list of strings.
@@ -0,0 +1,224 @@
+package iconscraper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxHeuristicFreshness caps how long a response without explicit freshness information is
+// considered fresh, based on its Last-Modified date.
+const maxHeuristicFreshness = 24 * time.Hour
+
+// diskCache is a HTTP cache storing successful responses on disk, one file per URL.
+//
+// It's a private cache, following the freshness rules of RFC 9111, and revalidating stale responses
+// with their ETag and Last-Modified validators.
+//
+// It is safe for concurrent use, including by multiple processes sharing the directory.
+type diskCache struct {
+	// dir is the directory the responses are stored in.
+	dir string
+
+	// clock used to determine freshness.
+	clock Clock
+}
+
+// cacheEntry is a response stored in the cache.
+type cacheEntry struct {
+	// URL the response was received from, after any redirects.
+	URL string `json:"url"`
+
+	// Status of the response.
+	Status int `json:"status"`
+
+	// ETag and LastModified are the validators from the response, used to revalidate it.
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+
+	// Expires is the time until which the response is fresh, and can be used without revalidating.
+	Expires time.Time `json:"expires"`
+
+	// Body of the response.
+	Body []byte `json:"body"`
+}
+
+// newDiskCache creates a cache from the config, or returns nil if caching is disabled.
+func newDiskCache(config Config, clock Clock) *diskCache {
+	if config.CacheDir == "" {
+		return nil
+	}
+	return &diskCache{
+		dir:   config.CacheDir,
+		clock: clock,
+	}
+}
+
+// path returns the path of the file the response for requestURL is stored in.
+func (cache *diskCache) path(requestURL string) string {
+	sum := sha256.Sum256([]byte(requestURL))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(cache.dir, key[:2], key+".json")
+}
+
+// load returns the cached response for requestURL, or nil if there isn't one.
+func (cache *diskCache) load(requestURL string) *cacheEntry {
+	data, err := os.ReadFile(cache.path(requestURL))
+	if err != nil {
+		return nil
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil
+	}
+	return &entry
+}
+
+// store writes the entry for requestURL, replacing any existing entry. Failures are ignored, since
+// the response can always be fetched again.
+func (cache *diskCache) store(requestURL string, entry *cacheEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	path := cache.path(requestURL)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return
+	}
+	// Write to a temporary file and rename it, so readers never see a partial entry.
+	file, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+}
+
+// fresh returns true if the entry can be used without revalidating it.
+func (cache *diskCache) fresh(entry *cacheEntry) bool {
+	return cache.clock.Now().Before(entry.Expires)
+}
+
+// revalidate adds the conditional headers to a request for a cached entry.
+func (entry *cacheEntry) revalidate(req *http.Request) {
+	if entry.ETag != "" {
+		req.Header.Set("If-None-Match", entry.ETag)
+	}
+	if entry.LastModified != "" {
+		req.Header.Set("If-Modified-Since", entry.LastModified)
+	}
+}
+
+// result converts the entry to the result of a request.
+func (entry *cacheEntry) result() httpResult {
+	u, err := url.Parse(entry.URL)
+	return httpResult{
+		url:    u,
+		status: entry.Status,
+		body:   entry.Body,
+		err:    err,
+	}
+}
+
+// update the cache with the result of a request for requestURL, which was a revalidation if cached is
+// not nil, and return the result to use.
+func (cache *diskCache) update(requestURL string, cached *cacheEntry, res httpResult) httpResult {
+	if res.err != nil {
+		return res
+	}
+	switch {
+	case res.status == http.StatusNotModified && cached != nil:
+		// The cached response is still good, so extend its freshness.
+		if expires, ok := cache.expires(res.header); ok {
+			cached.Expires = expires
+			if etag := res.header.Get("ETag"); etag != "" {
+				cached.ETag = etag
+			}
+			cache.store(requestURL, cached)
+		}
+		return cached.result()
+	case res.status == http.StatusOK:
+		if expires, ok := cache.expires(res.header); ok {
+			cache.store(requestURL, &cacheEntry{
+				URL:          res.url.String(),
+				Status:       res.status,
+				ETag:         res.header.Get("ETag"),
+				LastModified: res.header.Get("Last-Modified"),
+				Expires:      expires,
+				Body:         res.body,
+			})
+		}
+	}
+	return res
+}
+
+// expires determines when a response with the given headers stops being fresh, returning false if
+// it shouldn't be stored, either because it's forbidden, or because it's never fresh and can't be
+// revalidated.
+func (cache *diskCache) expires(header http.Header) (time.Time, bool) {
+	now := cache.clock.Now()
+	directives := parseCacheControl(header.Get("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return time.Time{}, false
+	}
+
+	expires := now
+	if _, ok := directives["no-cache"]; ok {
+		// Always revalidate.
+	} else if maxAge, ok := directives["max-age"]; ok {
+		seconds, _ := strconv.Atoi(maxAge)
+		age, _ := strconv.Atoi(header.Get("Age"))
+		expires = now.Add(time.Duration(seconds-age) * time.Second)
+	} else if expiresHeader := header.Get("Expires"); expiresHeader != "" {
+		// Use the difference from the server's date, so clock skew doesn't matter. An invalid date
+		// means it has already expired.
+		if date, err := http.ParseTime(expiresHeader); err == nil {
+			serverNow, err := http.ParseTime(header.Get("Date"))
+			if err != nil {
+				serverNow = now
+			}
+			expires = now.Add(date.Sub(serverNow))
+		}
+	} else if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		// Heuristic freshness: 10% of the time since it was last modified.
+		freshness := now.Sub(lastModified) / 10
+		if freshness > maxHeuristicFreshness {
+			freshness = maxHeuristicFreshness
+		}
+		if freshness > 0 {
+			expires = now.Add(freshness)
+		}
+	}
+
+	canRevalidate := header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+	return expires, expires.After(now) || canRevalidate
+}
+
+// parseCacheControl parses the directives of a Cache-Control header into a map from the lower case
+// directive name to its (unquoted) value.
+func parseCacheControl(header string) map[string]string {
+	directives := make(map[string]string)
+	for _, directive := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if name == "" {
+			continue
+		}
+		directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+	}
+	return directives
+}
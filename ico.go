@@ -0,0 +1,104 @@
+package iconscraper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// icoHeaderLen is the length of the header of an ICO or CUR file.
+	icoHeaderLen = 6
+	// icoEntryLen is the length of each entry in the directory following the header.
+	icoEntryLen = 16
+	// bmpFileHeaderLen is the length of the BMP file header, which is omitted from BMP images
+	// within ICO files.
+	bmpFileHeaderLen = 14
+	// bmpInfoHeaderLen is the length of the smallest BMP info header we support (BITMAPINFOHEADER).
+	bmpInfoHeaderLen = 40
+)
+
+// pngSignature is the start of every PNG file.
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// icoFrames splits an ICO or CUR file into a standalone PNG or BMP file for each of the images it
+// contains, in the order of its directory.
+//
+// Frames which are truncated or invalid are nil, with an error for each in skipped, so that one
+// broken frame doesn't lose the others. err is only returned if the file's header is invalid, or
+// none of its frames could be extracted.
+//
+// The format is described at https://en.wikipedia.org/wiki/ICO_(file_format).
+func icoFrames(data []byte) (frames [][]byte, skipped []error, err error) {
+	if len(data) < icoHeaderLen || binary.LittleEndian.Uint16(data) != 0 {
+		return nil, nil, fmt.Errorf("Invalid ICO header")
+	}
+	// Type 1 is an icon, and type 2 is a cursor.
+	if typ := binary.LittleEndian.Uint16(data[2:]); typ != 1 && typ != 2 {
+		return nil, nil, fmt.Errorf("Invalid ICO type %d", typ)
+	}
+	count := int(binary.LittleEndian.Uint16(data[4:]))
+	if len(data) < icoHeaderLen+count*icoEntryLen {
+		return nil, nil, fmt.Errorf("ICO directory is truncated")
+	}
+
+	frames = make([][]byte, count)
+	extracted := 0
+	for idx := range frames {
+		entry := data[icoHeaderLen+idx*icoEntryLen:]
+		size := int64(binary.LittleEndian.Uint32(entry[8:]))
+		offset := int64(binary.LittleEndian.Uint32(entry[12:]))
+		if offset+size > int64(len(data)) {
+			skipped = append(skipped, fmt.Errorf("ICO frame %d is truncated", idx+1))
+			continue
+		}
+		frame := data[offset : offset+size]
+		if !bytes.HasPrefix(frame, pngSignature) {
+			bmp, err := icoBitmap(frame)
+			if err != nil {
+				skipped = append(skipped, fmt.Errorf("ICO frame %d: %w", idx+1, err))
+				continue
+			}
+			frame = bmp
+		}
+		frames[idx] = frame
+		extracted++
+	}
+	if extracted == 0 {
+		if len(skipped) > 0 {
+			return nil, nil, skipped[0]
+		}
+		return nil, nil, fmt.Errorf("ICO has no frames")
+	}
+	return frames, skipped, nil
+}
+
+// icoBitmap converts a BMP image from an ICO file into a BMP file.
+//
+// Within an ICO file, the BMP file header is omitted, and the height in the info header is doubled,
+// since the image is followed by a 1-bit transparency mask. The mask is ignored.
+func icoBitmap(dib []byte) ([]byte, error) {
+	if len(dib) < bmpInfoHeaderLen {
+		return nil, fmt.Errorf("BMP header is truncated")
+	}
+	infoLen := binary.LittleEndian.Uint32(dib)
+	if infoLen < bmpInfoHeaderLen || infoLen > uint32(len(dib)) {
+		return nil, fmt.Errorf("Invalid BMP header length %d", infoLen)
+	}
+	// The palette follows the header, and the pixels follow the palette.
+	bitsPerPixel := binary.LittleEndian.Uint16(dib[14:])
+	colors := binary.LittleEndian.Uint32(dib[32:])
+	if colors == 0 && bitsPerPixel <= 8 {
+		colors = 1 << bitsPerPixel
+	}
+	pixelOffset := bmpFileHeaderLen + infoLen + 4*colors
+
+	bmp := make([]byte, bmpFileHeaderLen+len(dib))
+	copy(bmp, "BM")
+	binary.LittleEndian.PutUint32(bmp[2:], uint32(len(bmp)))
+	binary.LittleEndian.PutUint32(bmp[10:], pixelOffset)
+	copy(bmp[bmpFileHeaderLen:], dib)
+	height := int32(binary.LittleEndian.Uint32(dib[8:]))
+	binary.LittleEndian.PutUint32(bmp[bmpFileHeaderLen+8:], uint32(height/2))
+	return bmp, nil
+}
@@ -0,0 +1,172 @@
+package iconscraper
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// icoFile builds an ICO (or, if typ is 2, CUR) file containing frames.
+func icoFile(typ uint16, frames ...[]byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, [3]uint16{0, typ, uint16(len(frames))})
+	offset := icoHeaderLen + icoEntryLen*len(frames)
+	for _, frame := range frames {
+		// The sizes in the directory are unused.
+		buf.Write(make([]byte, 8))
+		binary.Write(&buf, binary.LittleEndian, [2]uint32{uint32(len(frame)), uint32(offset)})
+		offset += len(frame)
+	}
+	for _, frame := range frames {
+		buf.Write(frame)
+	}
+	return buf.Bytes()
+}
+
+// icoBitmapFrame builds a BMP image, as stored in an ICO file, with the given bits per pixel.
+func icoBitmapFrame(width, height int, bitsPerPixel uint16) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, struct {
+		InfoLen              uint32
+		Width, Height        int32
+		Planes, BitsPerPixel uint16
+		Compression          uint32
+		ImageSize            uint32
+		XRes, YRes           int32
+		Colors, Important    uint32
+	}{
+		InfoLen:      bmpInfoHeaderLen,
+		Width:        int32(width),
+		Height:       int32(2 * height),
+		Planes:       1,
+		BitsPerPixel: bitsPerPixel,
+	})
+	if bitsPerPixel <= 8 {
+		buf.Write(make([]byte, 4<<bitsPerPixel))
+	}
+	// The pixels, followed by the mask, with rows padded to 4 bytes.
+	rowLen := (width*int(bitsPerPixel) + 31) / 32 * 4
+	maskRowLen := (width + 31) / 32 * 4
+	buf.Write(make([]byte, (rowLen+maskRowLen)*height))
+	return buf.Bytes()
+}
+
+func TestIcoFrames(t *testing.T) {
+	ico := icoFile(1,
+		pngImage(16, 16).body,
+		icoBitmapFrame(32, 32, 32),
+		icoBitmapFrame(48, 48, 8),
+		icoBitmapFrame(24, 24, 4),
+	)
+	if typ := detectContentType(ico); typ != icoMimeType {
+		t.Fatal("expected ICO type, got", typ)
+	}
+	frames, skipped, err := icoFrames(ico)
+	if err != nil || skipped != nil {
+		t.Fatal(err, skipped)
+	}
+	if len(frames) != 4 {
+		t.Fatal("expected 4 frames, got", len(frames))
+	}
+	expected := []struct {
+		typ           string
+		width, height int
+	}{{"image/png", 16, 16}, {"image/bmp", 32, 32}, {"image/bmp", 48, 48}}
+	for idx, expected := range expected {
+		if typ := detectContentType(frames[idx]); typ != expected.typ {
+			t.Error("expected frame", idx, "to be", expected.typ, "got", typ)
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(frames[idx]))
+		if err != nil || config.Width != expected.width || config.Height != expected.height {
+			t.Error("failed to decode frame", idx, err, config.Width, config.Height)
+		}
+	}
+	// 4-bit BMPs are extracted, but can't be decoded.
+	if _, _, err := image.DecodeConfig(bytes.NewReader(frames[3])); err == nil {
+		t.Error("expected 4-bit BMP to fail to decode")
+	}
+
+	cur := icoFile(2, pngImage(32, 32).body)
+	if typ := detectContentType(cur); typ != icoMimeType {
+		t.Error("expected ICO type for cursor, got", typ)
+	}
+	if frames, _, err := icoFrames(cur); err != nil || len(frames) != 1 {
+		t.Error("failed to read cursor", err, len(frames))
+	}
+
+	// Broken frames are skipped, keeping the others.
+	broken := icoFile(1, pngImage(256, 256).body, make([]byte, 8), icoBitmapFrame(16, 16, 32))
+	frames, skipped, err = icoFrames(broken[:len(broken)-1])
+	if err != nil || len(frames) != 3 || frames[0] == nil || frames[1] != nil || frames[2] != nil || len(skipped) != 2 {
+		t.Error("expected only the first frame, got", err, skipped, len(frames))
+	}
+
+	for _, invalid := range [][]byte{ico[:4], ico[:30], icoFile(1), icoFile(3), icoFile(1, make([]byte, 8))} {
+		if _, _, err := icoFrames(invalid); err == nil {
+			t.Error("expected error for invalid ICO", invalid)
+		}
+	}
+}
+
+func TestIcoCandidates(t *testing.T) {
+	server := newTestServer(t, map[string]testSite{
+		"ico.test": {
+			"/":            htmlPage(``),
+			"/favicon.ico": {body: icoFile(1, icoBitmapFrame(16, 16, 32), pngImage(64, 64).body, icoBitmapFrame(32, 32, 24))},
+		},
+	})
+	config := Config{
+		TargetHeight:          24,
+		MaxConcurrentRequests: 4,
+		HTTPClient:            &http.Client{Transport: server.transport()},
+		Warnings:              make(chan error, 16),
+	}
+	candidates, err := GetCandidates(context.Background(), config, "ico.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 3 {
+		t.Fatal("expected a candidate for each frame, got", len(candidates))
+	}
+	best := pickBestImage(config, candidates)
+	if best.ImageConfig.Height != 32 || best.Type != "image/bmp" || best.Provenance.Frame != 3 {
+		t.Error("expected the 32px frame, got", best.Type, best.ImageConfig, best.Provenance)
+	}
+	if config, _, err := image.DecodeConfig(bytes.NewReader(best.Source)); err != nil || config.Height != 32 {
+		t.Error("expected a standalone image as the source", err)
+	}
+}
+
+func TestIcoCorruptFrame(t *testing.T) {
+	server := newTestServer(t, map[string]testSite{
+		"corrupt.test": {
+			"/":            htmlPage(``),
+			"/favicon.ico": {body: icoFile(1, pngImage(256, 256).body, []byte("not a bitmap"))},
+		},
+	})
+	warnings := make(chan error, 16)
+	config := Config{
+		MaxConcurrentRequests: 4,
+		HTTPClient:            &http.Client{Transport: server.transport()},
+		Warnings:              warnings,
+	}
+	candidates, err := GetCandidates(context.Background(), config, "corrupt.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 || candidates[0].ImageConfig.Height != 256 || candidates[0].Provenance.Frame != 1 {
+		t.Fatal("expected the good frame, got", candidates)
+	}
+	close(warnings)
+	found := false
+	for warning := range warnings {
+		found = found || strings.Contains(warning.Error(), "ICO frame 2")
+	}
+	if !found {
+		t.Error("expected a warning for the corrupt frame")
+	}
+}
@@ -2,12 +2,14 @@ package iconscraper
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"image"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	"net/http"
+	"sort"
 	"strings"
 
 	_ "golang.org/x/image/bmp"
@@ -19,6 +21,9 @@ import (
 // svgMimeType is the MIME type of an SVG image
 const svgMimeType = "image/svg+xml"
 
+// icoMimeType is the MIME type of an ICO or CUR file
+const icoMimeType = "image/x-icon"
+
 // xmlMimeType is the MIME type of an XML document
 const xmlMimeType = "text/xml"
 
@@ -47,18 +52,24 @@ func detectContentType(data []byte) string {
 //
 // It is not safe for concurrent use (though it does spawn concurrent workers).
 type imageWorkers struct {
+	// ctx is the context all requests are made with.
+	ctx context.Context
 	// domain is the domain they're scraping images from.
 	domain string
-	// resultChan is the channel workers send succesfully parsed icons on.
+	// resultChan is the channel workers send succesfully parsed icons on. A worker sends more than
+	// one icon if the file contains several images, like an ICO file.
 	//
 	// Each worker must send at most one result.
-	resultChan chan Icon
+	resultChan chan []Icon
 	// failureChan is used to signal that a worker has failed.
 	//
 	// A worker must send a message on this channel if and only if it does not send a result.
 	failureChan chan struct{}
 	// numImages is the total number of workers spawned.
 	numImages int
+	// spawned holds the normalised URLs workers have been spawned for, with the provenance of their
+	// most preferred reference (see precedes).
+	spawned map[string]Provenance
 	// http is the underlying HTTP worker pool.
 	http *httpWorkerPool
 	// errors is the channel to send errors to, as many errors as needed may be sent.
@@ -66,25 +77,48 @@ type imageWorkers struct {
 
 	// warnings channel to send warnings to.
 	warnings chan error
+
+	// maxDimension is the maximum width or height of images.
+	maxDimension int
+
+	// sanitizeSvg is true if SVGs should be sanitized.
+	sanitizeSvg bool
 }
 
-func newImageWorkers(domain string, http *httpWorkerPool, errors chan error, warnings chan error) imageWorkers {
+func newImageWorkers(ctx context.Context, config Config, domain string, http *httpWorkerPool) imageWorkers {
 	return imageWorkers{
-		domain:      domain,
-		resultChan:  make(chan Icon),
-		failureChan: make(chan struct{}),
-		http:        http,
-		errors:      errors,
-		warnings:    warnings,
+		ctx:          ctx,
+		domain:       domain,
+		resultChan:   make(chan []Icon),
+		failureChan:  make(chan struct{}),
+		spawned:      make(map[string]Provenance),
+		http:         http,
+		errors:       config.Errors,
+		warnings:     config.Warnings,
+		maxDimension: maxImageDimension(config),
+		sanitizeSvg:  config.SanitizeSvg,
 	}
 }
 
-// spawn a worker to collect and parse the image from url
+// spawn a worker to collect and parse the image from url, found from the reference described by
+// provenance, unless one has already been spawned for the same URL. If it has, the provenance is
+// recorded if it precedes the one already recorded, to be applied by results.
 //
 // It is not safe for concurrent use (though it does spawn concurrent workers).
-func (workers *imageWorkers) spawn(url string) {
+func (workers *imageWorkers) spawn(url string, provenance Provenance) {
+	if !isURL(url) {
+		url = "https://" + url
+	}
+	key := normalizeURL(url)
+	if existing, ok := workers.spawned[key]; ok {
+		if provenance.precedes(existing) {
+			workers.spawned[key] = provenance
+		}
+		return
+	}
+	workers.spawned[key] = provenance
 	workers.numImages += 1
-	go workers.getImage(url)
+	go workers.getImage(url, provenance)
 }
 
 // results waits for a collects the results from all previously spawned workers.
@@ -98,26 +132,35 @@ func (workers *imageWorkers) results() []Icon {
 	for idx := 0; idx < workers.numImages; idx++ {
 		select {
 		case result := <-workers.resultChan:
-			results = append(results, result)
+			results = append(results, result...)
 		case _ = <-workers.failureChan:
 		}
 	}
 	close(workers.resultChan)
+	// Use the provenance of the most preferred reference to each image, keeping the frame.
+	for idx := range results {
+		icon := &results[idx]
+		provenance := workers.spawned[normalizeURL(icon.URL)]
+		provenance.Frame = icon.Provenance.Frame
+		icon.Provenance = provenance
+	}
 	return results
 }
 
 // getImage fetches the image data from the specified URL, decodes its config, and returns information about the image.
 //
 // If the URL is valid however does not return an image (or returns a non-200 status), it is ignored.
-func (workers *imageWorkers) getImage(url string) {
+func (workers *imageWorkers) getImage(url string, provenance Provenance) {
 	if !isURL(url) {
 		url = "https://" + url
 	}
 
-	httpResult := workers.http.get(url)
-	// Report an error
+	httpResult := workers.http.get(workers.ctx, url, resourceImage)
+	// Report an error, unless it was caused by the context ending (the caller knows about that).
 	if httpResult.err != nil {
-		workers.errors <- fmt.Errorf("Failed to get icon %s: %w", url, httpResult.err)
+		if workers.ctx.Err() == nil {
+			reportFetchError(workers.errors, workers.warnings, fmt.Errorf("Failed to get icon %s: %w", url, httpResult.err))
+		}
 		workers.failureChan <- struct{}{}
 		return
 	}
@@ -135,72 +178,132 @@ func (workers *imageWorkers) getImage(url string) {
 		return
 	}
 
-	var img image.Config
-	var err error
-	// If it is *not* SVG decode the image config.
-	if typ != svgMimeType {
-		// Decode the image properties, and raise a warning if this doesn't work.
-		img, _, err = image.DecodeConfig(bytes.NewReader(body))
-		if err != nil {
-			workers.warnings <- fmt.Errorf("failed to decode image %s: %w", url, err)
-			workers.failureChan <- struct{}{}
-			return
+	var icons []Icon
+	switch typ {
+	case svgMimeType:
+		if workers.sanitizeSvg {
+			var ok bool
+			if body, ok = workers.sanitize(url, body); !ok {
+				break
+			}
+		}
+		icons = []Icon{{
+			URL:         url,
+			Type:        typ,
+			ImageConfig: svgConfig(body),
+			Source:      body,
+			Provenance:  provenance,
+		}}
+	case icoMimeType:
+		// Each image in an ICO file is a candidate of its own.
+		icons = workers.icoImages(url, body, provenance)
+	default:
+		if img, ok := workers.decodeConfig(url, body); ok {
+			icons = []Icon{{
+				URL:         url,
+				Type:        typ,
+				ImageConfig: img,
+				Source:      body,
+				Provenance:  provenance,
+			}}
 		}
 	}
-	workers.resultChan <- Icon{
-		URL:         url,
-		Type:        typ,
-		ImageConfig: img,
-		Source:      body,
+	if len(icons) == 0 {
+		workers.failureChan <- struct{}{}
+		return
 	}
+	workers.resultChan <- icons
 }
 
-// pickBestImage picks the image from the given list that best matches the target size.
-//
-// It chooses the smallest image taller than `targetHeight` or, if none exists, the largest image.
-// If there are no input images, or `squareOnly` is true and none are square, returns `nil`.
-//
-//		images := []imageData{
-//		    {name: "image1.jpg", size: size{1200, 800}},
-//		    {name: "image2.jpg", size: size{1920, 1080}},
-//		    {name: "image3.jpg", size: size{800, 600}},
-//		}
-//		targetHeight := 700
-//		bestImage := pickBestImage(squareOnly, targetHeight, images)
-//	    // bestImage.img.Height == 800
-func pickBestImage(config Config, images []Icon) *Icon {
-	// Track the largest image
-	var largestImage *Icon
-	// Track the smallest image larger than `targetHeight`
-	var smallestOkImage *Icon
-
-	for idx := range images {
-		image := &images[idx]
-		// Always prefer SVG icons
-		if config.AllowSvg && image.Type == svgMimeType {
-			return image
-		}
-		// Maybe skip non-square images
-		if config.SquareOnly && image.ImageConfig.Width != image.ImageConfig.Height {
+// sanitize returns the SVG with anything unsafe removed, raising a warning if anything was. If the
+// SVG can't be sanitized, a warning is raised and false is returned.
+func (workers *imageWorkers) sanitize(url string, body []byte) ([]byte, bool) {
+	sanitized, removed, err := sanitizeSvg(body)
+	if err != nil {
+		workers.warnings <- fmt.Errorf("failed to sanitize SVG %s: %w", url, err)
+		return nil, false
+	}
+	if len(removed) > 0 {
+		workers.warnings <- &SvgSanitizedError{URL: url, Removed: removed}
+	}
+	return sanitized, true
+}
+
+// icoImages returns an icon for each of the images within an ICO or CUR file, each with the
+// standalone PNG or BMP file as its source. Images which can't be decoded are ignored, with a
+// warning.
+func (workers *imageWorkers) icoImages(url string, body []byte, provenance Provenance) []Icon {
+	frames, skipped, err := icoFrames(body)
+	if err != nil {
+		workers.warnings <- fmt.Errorf("failed to decode image %s: %w", url, err)
+		return nil
+	}
+	for _, err := range skipped {
+		workers.warnings <- fmt.Errorf("failed to decode image %s: %w", url, err)
+	}
+	icons := make([]Icon, 0, len(frames))
+	for idx, frame := range frames {
+		if frame == nil {
 			continue
 		}
-
-		// Update `smallestOkImage`
-		diff := image.ImageConfig.Height - config.TargetHeight
-		if diff >= 0 {
-			if smallestOkImage == nil || image.ImageConfig.Height < smallestOkImage.ImageConfig.Height {
-				smallestOkImage = image
-			}
+		frameURL := fmt.Sprintf("%s (frame %d)", url, idx+1)
+		img, ok := workers.decodeConfig(frameURL, frame)
+		if !ok {
+			continue
 		}
+		frameProvenance := provenance
+		frameProvenance.Frame = idx + 1
+		icons = append(icons, Icon{
+			URL:         url,
+			Type:        detectContentType(frame),
+			ImageConfig: img,
+			Source:      frame,
+			Provenance:  frameProvenance,
+		})
+	}
+	return icons
+}
 
-		// Update `largestImage`
-		if largestImage == nil || image.ImageConfig.Height > largestImage.ImageConfig.Height {
-			largestImage = image
+// decodeConfig decodes the config of a non-vector image, returning false, and raising a warning, if
+// it can't be decoded or is too large.
+func (workers *imageWorkers) decodeConfig(url string, body []byte) (image.Config, bool) {
+	// Decode the image properties, and raise a warning if this doesn't work.
+	img, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		workers.warnings <- fmt.Errorf("failed to decode image %s: %w", url, err)
+		return img, false
+	}
+	// Ignore images which would use too much memory to decode.
+	if img.Width > workers.maxDimension || img.Height > workers.maxDimension {
+		workers.warnings <- &ImageTooLargeError{
+			URL:    url,
+			Width:  img.Width,
+			Height: img.Height,
+			Limit:  workers.maxDimension,
 		}
+		return img, false
 	}
+	return img, true
+}
 
-	if smallestOkImage != nil {
-		return smallestOkImage
-	}
-	return largestImage
+// sortCandidates sorts images with SVGs first, then from tallest to shortest, then widest to
+// narrowest, with ties broken by URL and frame, so the order doesn't depend on which images loaded
+// first.
+func sortCandidates(images []Icon) {
+	sort.SliceStable(images, func(i, j int) bool {
+		a, b := &images[i], &images[j]
+		if aSvg, bSvg := a.Type == svgMimeType, b.Type == svgMimeType; aSvg != bSvg {
+			return aSvg
+		}
+		if a.ImageConfig.Height != b.ImageConfig.Height {
+			return a.ImageConfig.Height > b.ImageConfig.Height
+		}
+		if a.ImageConfig.Width != b.ImageConfig.Width {
+			return a.ImageConfig.Width > b.ImageConfig.Width
+		}
+		if a.URL != b.URL {
+			return a.URL < b.URL
+		}
+		return a.Provenance.Frame < b.Provenance.Frame
+	})
 }
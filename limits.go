@@ -0,0 +1,122 @@
+package iconscraper
+
+import (
+	"fmt"
+)
+
+// Default limits, used when the corresponding Config field is zero.
+const (
+	defaultMaxHTMLBytes      = 5 << 20
+	defaultMaxManifestBytes  = 1 << 20
+	defaultMaxImageBytes     = 5 << 20
+	defaultMaxImageDimension = 4096
+
+	// maxRobotsBytes is the amount of a robots.txt file which is parsed, the minimum required by RFC
+	// 9309.
+	maxRobotsBytes = 500 << 10
+
+	// maxSvgElements is the number of elements an SVG may have to be rasterized.
+	maxSvgElements = 10000
+	// maxSvgPathSegments is the total number of path segments, after flattening curves for
+	// strokes, an SVG may draw to be rasterized.
+	maxSvgPathSegments = 100000
+	// maxSvgDrawnPixels is the total area, in pixels, of the shapes an SVG may draw to be
+	// rasterized, counting each shape's bounding box on the canvas.
+	maxSvgDrawnPixels = 1 << 26
+)
+
+// resourceKind is the kind of resource being fetched, which determines its size limit.
+type resourceKind int
+
+const (
+	resourceHTML resourceKind = iota
+	resourceManifest
+	resourceImage
+	resourceRobots
+)
+
+func (kind resourceKind) String() string {
+	switch kind {
+	case resourceHTML:
+		return "HTML page"
+	case resourceManifest:
+		return "manifest"
+	case resourceImage:
+		return "image"
+	case resourceRobots:
+		return "robots.txt"
+	}
+	return "resource"
+}
+
+// sizeLimits are the maximum body sizes, in bytes, for each kind of resource.
+type sizeLimits map[resourceKind]int64
+
+// newSizeLimits returns the size limits from the config, with defaults for those unset.
+func newSizeLimits(config Config) sizeLimits {
+	limits := sizeLimits{
+		resourceHTML:     config.MaxHTMLBytes,
+		resourceManifest: config.MaxManifestBytes,
+		resourceImage:    config.MaxImageBytes,
+		resourceRobots:   maxRobotsBytes,
+	}
+	defaults := sizeLimits{
+		resourceHTML:     defaultMaxHTMLBytes,
+		resourceManifest: defaultMaxManifestBytes,
+		resourceImage:    defaultMaxImageBytes,
+	}
+	for kind, limit := range limits {
+		if limit == 0 {
+			limits[kind] = defaults[kind]
+		}
+	}
+	return limits
+}
+
+// truncates returns true if responses for this kind of resource which are larger than the limit
+// should be truncated, rather than rejected.
+func (kind resourceKind) truncates() bool {
+	return kind == resourceRobots
+}
+
+// maxImageDimension returns the maximum width or height of an image from the config.
+func maxImageDimension(config Config) int {
+	if config.MaxImageDimension == 0 {
+		return defaultMaxImageDimension
+	}
+	return config.MaxImageDimension
+}
+
+// ResponseTooLargeError is the warning reported when a response body is larger than the limit for
+// its kind of resource. The resource is ignored.
+type ResponseTooLargeError struct {
+	// URL of the resource.
+	URL string
+
+	// Resource is the kind of resource: "HTML page", "manifest" or "image".
+	Resource string
+
+	// Limit is the maximum size allowed, in bytes.
+	Limit int64
+}
+
+func (err *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("%s %s is larger than the limit of %d bytes", err.Resource, err.URL, err.Limit)
+}
+
+// ImageTooLargeError is the warning reported when an image has a width or height larger than
+// Config.MaxImageDimension. The image is ignored.
+type ImageTooLargeError struct {
+	// URL of the image.
+	URL string
+
+	// Width and Height of the image, in pixels.
+	Width, Height int
+
+	// Limit is the maximum width or height allowed, in pixels.
+	Limit int
+}
+
+func (err *ImageTooLargeError) Error() string {
+	return fmt.Sprintf("image %s is %dx%d, larger than the limit of %d pixels", err.URL, err.Width, err.Height, err.Limit)
+}
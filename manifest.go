@@ -14,11 +14,13 @@ import (
 // - Sizes (string): The size(s) of the icon, typically specified as width x height (e.g., "16x16").
 // - Type (string): The MIME type or file format of the icon (e.g., "image/png").
 // - Density (string): The pixel density descriptor of the icon (e.g., "1x").
+// - Purpose (string): The contexts the icon is designed for (e.g., "maskable").
 type icon struct {
 	Src     string `json:"src"`
 	Sizes   string `json:"sizes"`
 	Type    string `json:"type"`
 	Density string `json:"density"`
+	Purpose string `json:"purpose"`
 }
 
 // app is a struct used to decode JSON data that holds information about a web app's manifest.
@@ -37,10 +39,12 @@ type app struct {
 // (https://developer.mozilla.org/en-US/docs/Web/Manifest), and then spawns workers to process the
 // icons defined.
 func processManifest(domain, manifestUrl string, workers *imageWorkers) {
-	httpResult := workers.http.get(manifestUrl)
-	// Report an error
+	httpResult := workers.http.get(workers.ctx, manifestUrl, resourceManifest)
+	// Report an error, unless it was caused by the context ending.
 	if httpResult.err != nil {
-		workers.errors <- httpResult.err
+		if workers.ctx.Err() == nil {
+			reportFetchError(workers.errors, workers.warnings, httpResult.err)
+		}
 		return
 	}
 	// Ignore things that aren't 200 (they won't be the manifest!)
@@ -59,6 +63,12 @@ func processManifest(domain, manifestUrl string, workers *imageWorkers) {
 
 	// Spawn an image worker for each icon
 	for _, icon := range manifest.Icons {
-		workers.spawn(getURL(domain, icon.Src))
+		workers.spawn(getURL(domain, icon.Src), Provenance{
+			Kind:     SourceManifest,
+			Sizes:    icon.Sizes,
+			Type:     icon.Type,
+			Purpose:  icon.Purpose,
+			Referrer: manifestUrl,
+		})
 	}
 }
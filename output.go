@@ -0,0 +1,200 @@
+package iconscraper
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+)
+
+// defaultOutputType is the format output icons are encoded in if Config.OutputType isn't set.
+const defaultOutputType = "image/png"
+
+// outputEncoders encode images in each of the supported output types.
+var outputEncoders = map[string]func(w io.Writer, img image.Image) error{
+	"image/png": png.Encode,
+	"image/jpeg": func(w io.Writer, img image.Image) error {
+		// JPEGs don't have transparency, so draw onto white rather than black.
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		return jpeg.Encode(w, flat, &jpeg.Options{Quality: 90})
+	},
+	"image/gif": func(w io.Writer, img image.Image) error {
+		return gif.Encode(w, img, nil)
+	},
+	"image/bmp": bmp.Encode,
+}
+
+// outputIcon decodes an icon, resamples it to the size given by the config, and encodes it as
+// config.OutputType.
+//
+// If both config.TargetWidth and config.TargetHeight are set, the image is resized to exactly that
+// size, otherwise its aspect ratio is kept, as for rasterizeIcon. SVGs are rasterized at the size,
+// keeping their aspect ratio and centring them.
+//
+// If config.TrimBorders is set, the image's borders are trimmed first, so its content fills the
+// size. Trimmed images are kept at their own size unless config.Resize is set. If they're resized
+// to an exact size, they're scaled to fit within it, keeping their aspect ratio, and centred on a
+// canvas of that size filled with config.PadColor.
+//
+// If the icon is to be padded, it's scaled to fit a square canvas of the size given by
+// squareSize, keeping its aspect ratio, and centred on it.
+func outputIcon(ctx context.Context, config Config, icon *Icon) (*Icon, error) {
+	typ := config.OutputType
+	if typ == "" {
+		typ = defaultOutputType
+	}
+	encode, ok := outputEncoders[typ]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported output type %s", typ)
+	}
+
+	// img is nil for SVGs that aren't trimmed, which are rasterized once the size is known.
+	var img image.Image
+	original := icon.ImageConfig
+	if icon.Type != svgMimeType {
+		decoded, _, err := image.Decode(bytes.NewReader(icon.Source))
+		if err != nil {
+			return nil, err
+		}
+		img = decoded
+		if config.TrimBorders {
+			img = trimBorders(config, img)
+		}
+	} else if config.TrimBorders {
+		trimmed, err := trimSvg(ctx, config, icon)
+		if err != nil {
+			return nil, err
+		}
+		img = trimmed
+	}
+	if img != nil {
+		original = image.Config{Width: img.Bounds().Dx(), Height: img.Bounds().Dy()}
+	}
+
+	width, height := outputSize(config, original)
+	// canvasWidth and canvasHeight are the size of the canvas the image is centred on, if any.
+	canvasWidth, canvasHeight := 0, 0
+	switch {
+	case icon.Padded:
+		side := squareSize(config, original)
+		canvasWidth, canvasHeight = side, side
+		width, height = fitSize(original, side, side)
+	case config.TrimBorders && !config.Resize:
+		// Trimmed icons are kept at their own size unless they're to be resized.
+		width, height = original.Width, original.Height
+	case config.TrimBorders && config.TargetWidth > 0 && config.TargetHeight > 0:
+		// Rather than stretching the trimmed content to the exact size, fit it within it.
+		canvasWidth, canvasHeight = width, height
+		width, height = fitSize(original, width, height)
+	}
+	if img == nil {
+		raster, err := rasterizeSvg(ctx, icon.Source, width, height)
+		if err != nil {
+			return nil, err
+		}
+		img = raster
+	} else {
+		img = resample(img, width, height)
+	}
+	if canvasWidth != 0 {
+		img = centreOnCanvas(img, canvasWidth, canvasHeight, config.PadColor)
+		width, height = canvasWidth, canvasHeight
+	}
+
+	var buf bytes.Buffer
+	if err := encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return &Icon{
+		URL:  icon.URL,
+		Type: typ,
+		ImageConfig: image.Config{
+			ColorModel: img.ColorModel(),
+			Width:      width,
+			Height:     height,
+		},
+		Source:     buf.Bytes(),
+		Provenance: icon.Provenance,
+		Padded:     icon.Padded,
+	}, nil
+}
+
+// outputSize returns the size an image with the given config should be output at.
+func outputSize(config Config, original image.Config) (width, height int) {
+	if config.TargetWidth > 0 && config.TargetHeight > 0 {
+		return rasterSize(config, image.Config{Width: config.TargetWidth, Height: config.TargetHeight})
+	}
+	return rasterSize(config, original)
+}
+
+// squareSize returns the size of the square canvas to pad an image with the given config onto: the
+// target height or width if config.Resize is set, otherwise the longest side of the image.
+func squareSize(config Config, original image.Config) int {
+	side := 0
+	switch {
+	case config.Resize && config.TargetHeight > 0:
+		side = config.TargetHeight
+	case config.Resize && config.TargetWidth > 0:
+		side = config.TargetWidth
+	case original.Width > original.Height:
+		side = original.Width
+	default:
+		side = original.Height
+	}
+	if side == 0 {
+		side = defaultRasterHeight
+	}
+	if limit := maxImageDimension(config); side > limit {
+		side = limit
+	}
+	return side
+}
+
+// fitSize returns the size to scale an image with the given config to, to fit within a box of
+// boxWidth by boxHeight, keeping its aspect ratio.
+func fitSize(original image.Config, boxWidth, boxHeight int) (width, height int) {
+	if original.Width <= 0 || original.Height <= 0 {
+		return boxWidth, boxHeight
+	}
+	w, h := float64(original.Width), float64(original.Height)
+	// Compare the aspect ratios without dividing.
+	if original.Width*boxHeight > original.Height*boxWidth {
+		return boxWidth, roundDimension(float64(boxWidth) * h / w)
+	}
+	return roundDimension(float64(boxHeight) * w / h), boxHeight
+}
+
+// centreOnCanvas centres img on a canvas of width by height filled with background, or transparent
+// if background is nil.
+func centreOnCanvas(img image.Image, width, height int, background color.Color) image.Image {
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	if background != nil {
+		draw.Draw(canvas, canvas.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	}
+	bounds := img.Bounds()
+	offset := image.Pt((width-bounds.Dx())/2, (height-bounds.Dy())/2)
+	draw.Draw(canvas, bounds.Sub(bounds.Min).Add(offset), img, bounds.Min, draw.Over)
+	return canvas
+}
+
+// resample scales img to exactly width by height, with a Catmull-Rom filter. If it's already that
+// size, it's returned unchanged.
+func resample(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() == width && bounds.Dy() == height {
+		return img
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
@@ -0,0 +1,193 @@
+package iconscraper
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+func TestOutputIcon(t *testing.T) {
+	solid := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for idx := range solid.Pix {
+		solid.Pix[idx] = 0xff
+	}
+	var gifBuf bytes.Buffer
+	if err := gif.Encode(&gifBuf, solid, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		icon          Icon
+		config        Config
+		width, height int
+		typ           string
+		center        string
+	}{
+		{
+			"png to exact size",
+			Icon{Type: "image/png", Source: pngImage(180, 180).body},
+			Config{TargetWidth: 64, TargetHeight: 48},
+			64, 48, "image/png", "00000000",
+		},
+		{
+			"gif keeping aspect ratio",
+			Icon{Type: "image/gif", Source: gifBuf.Bytes(), ImageConfig: image.Config{Width: 40, Height: 20}},
+			Config{TargetHeight: 64},
+			128, 64, "image/png", "ffffffff",
+		},
+		{
+			"transparent to jpeg",
+			Icon{Type: "image/png", Source: pngImage(32, 32).body, ImageConfig: image.Config{Width: 32, Height: 32}},
+			Config{OutputType: "image/jpeg"},
+			32, 32, "image/jpeg", "ffffffff",
+		},
+		{
+			"bmp frame",
+			Icon{Type: "image/bmp", Source: mustIcoFrame(t, icoBitmapFrame(16, 16, 32)), ImageConfig: image.Config{Width: 16, Height: 16}},
+			Config{TargetHeight: 32, OutputType: "image/bmp"},
+			32, 32, "image/bmp", "",
+		},
+		{
+			"svg",
+			Icon{Type: svgMimeType, Source: svgImage.body, ImageConfig: image.Config{Width: 24, Height: 24}},
+			Config{TargetWidth: 48, TargetHeight: 32, OutputType: "image/gif"},
+			48, 32, "image/gif", "ff0000ff",
+		},
+	}
+	for _, test := range tests {
+		output, err := outputIcon(context.Background(), test.config, &test.icon)
+		if err != nil {
+			t.Error(test.name, err)
+			continue
+		}
+		img, format, err := image.Decode(bytes.NewReader(output.Source))
+		if err != nil {
+			t.Error(test.name, err)
+			continue
+		}
+		if output.Type != test.typ || "image/"+format != test.typ {
+			t.Error(test.name, "expected", test.typ, "got", output.Type, format)
+		}
+		size := img.Bounds().Size()
+		if size.X != test.width || size.Y != test.height || output.ImageConfig.Width != test.width || output.ImageConfig.Height != test.height {
+			t.Error(test.name, "expected", test.width, test.height, "got", size, output.ImageConfig)
+		}
+		if test.center != "" {
+			c := color.NRGBAModel.Convert(img.At(size.X/2, size.Y/2)).(color.NRGBA)
+			if got := hexColor(c); got != test.center {
+				t.Error(test.name, "expected", test.center, "in the center, got", got)
+			}
+		}
+	}
+
+	if _, err := outputIcon(context.Background(), Config{OutputType: "image/tiff"}, &tests[0].icon); err == nil {
+		t.Error("expected an error for an unsupported type")
+	}
+}
+
+// mustIcoFrame extracts the single frame from an ICO containing frame.
+func mustIcoFrame(t *testing.T, frame []byte) []byte {
+	frames, _, err := icoFrames(icoFile(1, frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frames[0]
+}
+
+func TestResizeIcons(t *testing.T) {
+	server := newTestServer(t, testSites)
+	config := Config{
+		TargetHeight:          100,
+		SquareOnly:            true,
+		Resize:                true,
+		MaxConcurrentRequests: 4,
+		HTTPClient:            &http.Client{Transport: server.transport()},
+	}
+	icon := GetIcon(config, "icons.test")
+	if icon == nil || icon.ImageConfig.Height != 144 {
+		t.Fatal("expected the 144px icon, got", icon)
+	}
+	if icon.Output == nil || icon.Output.Type != "image/png" || icon.Output.ImageConfig.Width != 100 || icon.Output.ImageConfig.Height != 100 {
+		t.Fatal("expected a 100px output, got", icon.Output)
+	}
+	if config, _, err := image.DecodeConfig(bytes.NewReader(icon.Output.Source)); err != nil || config.Width != 100 || config.Height != 100 {
+		t.Error("expected the output to decode as 100px", err, config)
+	}
+}
+
+func TestPadToSquare(t *testing.T) {
+	// A red logo, twice as wide as it is tall.
+	logo := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(logo, logo.Bounds(), image.NewUniform(color.RGBA{0xff, 0, 0, 0xff}), image.Point{}, draw.Src)
+	var logoSource bytes.Buffer
+	png.Encode(&logoSource, logo)
+
+	server := newTestServer(t, map[string]testSite{
+		"logo.test": {
+			"/":         htmlPage(`<link rel="icon" href="/logo.png">`),
+			"/logo.png": {body: logoSource.Bytes()},
+		},
+	})
+	config := Config{
+		SquareOnly:            true,
+		PadToSquare:           true,
+		MaxConcurrentRequests: 4,
+		HTTPClient:            &http.Client{Transport: server.transport()},
+	}
+
+	tests := []struct {
+		resize     bool
+		background color.Color
+		side       int
+		corner     string
+	}{
+		{false, nil, 200, "00000000"},
+		{true, color.White, 64, "ffffffff"},
+	}
+	for _, test := range tests {
+		config.Resize = test.resize
+		config.TargetHeight = 64
+		config.PadColor = test.background
+		icon := GetIcon(config, "logo.test")
+		if icon == nil || !icon.Padded || icon.ImageConfig.Width != 200 {
+			t.Fatal("expected the padded logo, got", icon)
+		}
+		output := icon.Output
+		if output == nil || !output.Padded || output.ImageConfig.Width != test.side || output.ImageConfig.Height != test.side {
+			t.Fatal("expected a", test.side, "pixel square output, got", output)
+		}
+		img, err := png.Decode(bytes.NewReader(output.Source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		at := func(x, y int) string {
+			return hexColor(color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA))
+		}
+		if at(0, 0) != test.corner || at(test.side-1, test.side-1) != test.corner {
+			t.Error("expected", test.corner, "corners, got", at(0, 0), at(test.side-1, test.side-1))
+		}
+		if at(test.side/2, test.side/2) != "ff0000ff" || at(0, test.side/2) != "ff0000ff" {
+			t.Error("expected the logo across the middle, got", at(test.side/2, test.side/2), at(0, test.side/2))
+		}
+	}
+
+	// If it can't be padded, there's no icon.
+	config.OutputType = "image/tiff"
+	if icon := GetIcon(config, "logo.test"); icon != nil {
+		t.Error("expected no icon without a padded output, got", icon)
+	}
+
+	// Without PadToSquare, there's no icon.
+	config.OutputType = ""
+	config.PadToSquare = false
+	if icon := GetIcon(config, "logo.test"); icon != nil {
+		t.Error("expected no icon, got", icon)
+	}
+}
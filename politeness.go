@@ -0,0 +1,196 @@
+package iconscraper
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// sweepInterval is the number of releases between sweeps of idle hosts from a politeness limiter.
+const sweepInterval = 1024
+
+// politeness limits the requests made to each host, and the overall request rate.
+//
+// It is safe for concurrent use.
+type politeness struct {
+	// clock used to time rate limits.
+	clock Clock
+
+	// maxPerHost is the maximum number of concurrent requests to a host, or 0 for no limit.
+	maxPerHost int
+	// hostInterval is the minimum time between starting requests to a host, or 0 for no limit.
+	hostInterval time.Duration
+	// interval is the minimum time between starting any requests, or 0 for no limit.
+	interval time.Duration
+
+	// mu guards the fields below.
+	mu sync.Mutex
+	// next is the earliest time the next request may start.
+	next time.Time
+	// hosts holds the state of each host with active or recent requests.
+	hosts map[string]*hostState
+	// releases counts releases since the last sweep.
+	releases int
+}
+
+// hostState is the state of requests to a single host.
+type hostState struct {
+	// active is the number of requests holding a slot for the host.
+	active int
+	// waiters are the channels of requests waiting for a slot, in order. A waiter's channel is
+	// closed when a slot is handed to it.
+	waiters []chan struct{}
+	// next is the earliest time the next request to this host may start.
+	next time.Time
+}
+
+// newPoliteness creates a limiter from the config, or returns nil if no limits are set.
+func newPoliteness(config Config, clock Clock) *politeness {
+	if config.MaxConcurrentRequestsPerHost == 0 && config.RequestsPerSecondPerHost == 0 && config.RequestsPerSecond == 0 {
+		return nil
+	}
+	return &politeness{
+		clock:        clock,
+		maxPerHost:   config.MaxConcurrentRequestsPerHost,
+		hostInterval: rateInterval(config.RequestsPerSecondPerHost),
+		interval:     rateInterval(config.RequestsPerSecond),
+		hosts:        make(map[string]*hostState),
+	}
+}
+
+// rateInterval converts a rate per second to the interval between events, or 0 if there's no limit.
+func rateInterval(perSecond float64) time.Duration {
+	if perSecond <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / perSecond)
+}
+
+// hostOf returns the host of a URL, or the URL itself if it can't be parsed.
+func hostOf(rawURL string) string {
+	if !isURL(rawURL) {
+		rawURL = "https://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Host
+}
+
+// acquire waits for a slot for a request to host, and returns a function which must be called
+// when the request has finished. The request must then wait for the rate limits, with wait, just
+// before it starts.
+//
+// If ctx is done first, its error is returned.
+func (limiter *politeness) acquire(ctx context.Context, host string) (func(), error) {
+	limiter.mu.Lock()
+	state := limiter.hosts[host]
+	if state == nil {
+		state = &hostState{}
+		limiter.hosts[host] = state
+	}
+	release := func() {
+		limiter.release(host)
+	}
+
+	if limiter.maxPerHost == 0 || state.active < limiter.maxPerHost {
+		state.active++
+		limiter.mu.Unlock()
+		return release, nil
+	}
+	ready := make(chan struct{})
+	state.waiters = append(state.waiters, ready)
+	limiter.mu.Unlock()
+	select {
+	case <-ready:
+		return release, nil
+	case <-ctx.Done():
+		limiter.mu.Lock()
+		if !limiter.removeWaiter(state, ready) {
+			// We were handed a slot as the context ended, so hand it on.
+			limiter.mu.Unlock()
+			limiter.release(host)
+		} else {
+			limiter.mu.Unlock()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// wait waits until a request to host, holding a slot from acquire, may start under the rate limits.
+// It's called as the request is about to start, so that the time spent queued for a worker doesn't
+// count towards the interval between requests.
+//
+// If ctx is done first, its error is returned.
+func (limiter *politeness) wait(ctx context.Context, host string) error {
+	// Reserve the earliest start time allowed by both rate limits.
+	limiter.mu.Lock()
+	state := limiter.hosts[host]
+	now := limiter.clock.Now()
+	start := now
+	if state.next.After(start) {
+		start = state.next
+	}
+	if limiter.next.After(start) {
+		start = limiter.next
+	}
+	state.next = start.Add(limiter.hostInterval)
+	limiter.next = start.Add(limiter.interval)
+	limiter.mu.Unlock()
+
+	if wait := start.Sub(now); wait > 0 {
+		select {
+		case <-limiter.clock.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// removeWaiter removes ready from the waiters of state, returning false if it's no longer waiting.
+//
+// limiter.mu must be held.
+func (limiter *politeness) removeWaiter(state *hostState, ready chan struct{}) bool {
+	for idx, waiter := range state.waiters {
+		if waiter == ready {
+			state.waiters = append(state.waiters[:idx], state.waiters[idx+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// release gives up a slot for host, handing it to the next waiter, if there is one.
+func (limiter *politeness) release(host string) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	state := limiter.hosts[host]
+	if len(state.waiters) > 0 {
+		close(state.waiters[0])
+		state.waiters = state.waiters[1:]
+	} else {
+		state.active--
+	}
+
+	limiter.releases++
+	if limiter.releases >= sweepInterval {
+		limiter.releases = 0
+		limiter.sweep()
+	}
+}
+
+// sweep forgets hosts which have no requests and whose rate limits have expired.
+//
+// limiter.mu must be held.
+func (limiter *politeness) sweep() {
+	now := limiter.clock.Now()
+	for host, state := range limiter.hosts {
+		if state.active == 0 && len(state.waiters) == 0 && !state.next.After(now) {
+			delete(limiter.hosts, host)
+		}
+	}
+}
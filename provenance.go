@@ -0,0 +1,60 @@
+package iconscraper
+
+// SourceKind is the kind of reference an icon was found from.
+type SourceKind string
+
+const (
+	// SourceFavicon is the `/favicon.ico` file, which is always checked.
+	SourceFavicon SourceKind = "favicon.ico"
+	// SourceLink is a `<link>` element in the HTML page.
+	SourceLink SourceKind = "link"
+	// SourceManifest is an icon in a web app manifest.
+	SourceManifest SourceKind = "manifest"
+	// SourceMeta is a `<meta itemprop="image">` element in the HTML page.
+	SourceMeta SourceKind = "meta"
+)
+
+// Provenance records where an icon was found, and what was declared about it there.
+//
+// If the same image is referenced more than once, the provenance is from the first of the page's
+// links and meta elements referencing it, or if there are none, the first of the manifests' icons,
+// or otherwise the `/favicon.ico` check.
+type Provenance struct {
+	// Kind of reference the icon was found from.
+	Kind SourceKind
+
+	// Attribute is the value of the attribute that identified the reference as an icon: the `rel`
+	// of a link, or the `itemprop` of a meta element. It's empty for the other kinds.
+	Attribute string
+
+	// Sizes, Type and Purpose are the values declared by the reference, from the `sizes` and `type`
+	// attributes of a link, or the `sizes`, `type` and `purpose` members of a manifest icon. They're
+	// empty if not declared, and aren't checked against the image.
+	Sizes   string
+	Type    string
+	Purpose string
+
+	// Referrer is the URL of the document containing the reference: the HTML page or the manifest.
+	// It's empty for `/favicon.ico`.
+	Referrer string
+
+	// Frame is the position, from 1, of the image within an ICO or CUR file, whose images are each
+	// a separate candidate. It's 0 for other files.
+	Frame int
+}
+
+// precedes returns true if provenance is from a kind of reference recorded in preference to other:
+// the page's links and meta elements, then the manifest's icons, then the `/favicon.ico` check.
+// References of the same precedence are recorded in the order they're found.
+func (provenance Provenance) precedes(other Provenance) bool {
+	rank := func(kind SourceKind) int {
+		switch kind {
+		case SourceLink, SourceMeta:
+			return 0
+		case SourceManifest:
+			return 1
+		}
+		return 2
+	}
+	return rank(provenance.Kind) < rank(other.Kind)
+}
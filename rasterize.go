@@ -0,0 +1,1420 @@
+package iconscraper
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/vector"
+)
+
+// svgNamespace is the namespace of SVG elements.
+const svgNamespace = "http://www.w3.org/2000/svg"
+
+// defaultRasterHeight is the height SVGs are rasterized at if neither the target size nor the SVG's
+// nominal size is known.
+const defaultRasterHeight = 256
+
+// rasterizeIcon rasterizes an SVG icon to a PNG icon.
+//
+// It's rasterized at config.TargetHeight or, if that's not set, config.TargetWidth, keeping the
+// SVG's aspect ratio. If neither is set, the SVG's nominal size is used.
+func rasterizeIcon(ctx context.Context, config Config, icon *Icon) (*Icon, error) {
+	width, height := rasterSize(config, icon.ImageConfig)
+	img, err := rasterizeSvg(ctx, icon.Source, width, height)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return &Icon{
+		URL:  icon.URL,
+		Type: "image/png",
+		ImageConfig: image.Config{
+			ColorModel: img.ColorModel(),
+			Width:      width,
+			Height:     height,
+		},
+		Source:     buf.Bytes(),
+		Provenance: icon.Provenance,
+	}, nil
+}
+
+// rasterSize returns the size to rasterize an SVG with the given nominal size at, no larger than
+// maxImageDimension(config).
+func rasterSize(config Config, nominal image.Config) (width, height int) {
+	// aspect is the width divided by the height, assumed to be square if unknown.
+	aspect := 1.0
+	if nominal.Width > 0 && nominal.Height > 0 {
+		aspect = float64(nominal.Width) / float64(nominal.Height)
+	}
+	var w, h float64
+	switch {
+	case config.TargetHeight > 0:
+		h = float64(config.TargetHeight)
+		w = h * aspect
+	case config.TargetWidth > 0:
+		w = float64(config.TargetWidth)
+		h = w / aspect
+	case nominal.Height > 0:
+		w, h = float64(nominal.Width), float64(nominal.Height)
+	default:
+		h = defaultRasterHeight
+		w = h * aspect
+	}
+	// Scale down to fit within the limit.
+	if limit := float64(maxImageDimension(config)); w > limit || h > limit {
+		scale := math.Min(limit/w, limit/h)
+		w, h = w*scale, h*scale
+	}
+	return roundDimension(w), roundDimension(h)
+}
+
+// rasterizeSvg draws an SVG image at the given size.
+//
+// It supports the subset of SVG commonly used by icons: paths, basic shapes, transforms, and solid
+// fills and strokes, with opacity. Strokes always have round joins. An SVG using anything it can't
+// draw correctly (see svgUnsupportedFeature) isn't drawn, so a bitmap can be used instead.
+//
+// SVGs with more than maxSvgElements elements or maxSvgPathSegments path segments, or whose shapes
+// cover more than maxSvgDrawnPixels, aren't drawn, and drawing stops with an error if ctx ends.
+func rasterizeSvg(ctx context.Context, data []byte, width, height int) (*image.RGBA, error) {
+	renderer := svgRenderer{
+		ctx: ctx,
+		dst: image.NewRGBA(image.Rect(0, 0, width, height)),
+	}
+	if err := renderer.render(data); err != nil {
+		return nil, err
+	}
+	return renderer.dst, nil
+}
+
+// svgNonRendered are the elements whose content is only drawn when it's referenced from elsewhere,
+// or not at all. References to them are unsupported, so they're skipped.
+var svgNonRendered = map[string]bool{
+	"defs":           true,
+	"clipPath":       true,
+	"mask":           true,
+	"symbol":         true,
+	"pattern":        true,
+	"marker":         true,
+	"linearGradient": true,
+	"radialGradient": true,
+	"filter":         true,
+	"title":          true,
+	"desc":           true,
+	"metadata":       true,
+	"script":         true,
+}
+
+// svgUnsupportedElements are the elements which affect the image but which can't be drawn.
+var svgUnsupportedElements = map[string]bool{
+	"use":           true,
+	"style":         true,
+	"text":          true,
+	"image":         true,
+	"foreignObject": true,
+	"switch":        true,
+}
+
+// svgUnsupportedProperties are the properties which can't be drawn, unless their value is "none".
+var svgUnsupportedProperties = []string{
+	"clip-path",
+	"mask",
+	"filter",
+	"marker-start",
+	"marker-mid",
+	"marker-end",
+	"stroke-dasharray",
+}
+
+// svgUnsupportedFeature returns a description of the feature used by an element which can't be
+// drawn correctly, or an empty string if there isn't one.
+func svgUnsupportedFeature(element xml.StartElement) string {
+	if svgUnsupportedElements[element.Name.Local] {
+		return "<" + element.Name.Local + "> element"
+	}
+	props := svgProperties(element.Attr)
+	if strings.TrimSpace(props["fill-rule"]) == "evenodd" {
+		return "fill-rule: evenodd"
+	}
+	for _, name := range svgUnsupportedProperties {
+		if value := strings.TrimSpace(props[name]); value != "" && value != "none" {
+			return name
+		}
+	}
+	// Paint servers: gradients and patterns.
+	for _, name := range []string{"fill", "stroke"} {
+		if strings.HasPrefix(strings.TrimSpace(props[name]), "url(") {
+			return name + " referencing a paint server"
+		}
+	}
+	return ""
+}
+
+// svgRenderer draws an SVG image.
+type svgRenderer struct {
+	ctx context.Context
+	dst *image.RGBA
+	// z is reused to draw each shape, covering just the shape's bounding box.
+	z vector.Rasterizer
+	// elements, segments and pixels count the elements, path segments and pixels drawn so far.
+	elements, segments, pixels int
+}
+
+// svgPaintKind is the kind of paint used to fill or stroke a shape.
+type svgPaintKind int
+
+const (
+	svgPaintNone svgPaintKind = iota
+	svgPaintColor
+	svgPaintCurrentColor
+)
+
+// svgPaint is the value of a fill or stroke property.
+type svgPaint struct {
+	kind svgPaintKind
+	// color if the kind is svgPaintColor.
+	color color.NRGBA
+}
+
+// svgState is the style and transform in effect for an element.
+type svgState struct {
+	transform affine
+	fill      svgPaint
+	stroke    svgPaint
+	// color is the value of currentColor.
+	color         color.NRGBA
+	strokeWidth   float64
+	lineCap       string
+	opacity       float64
+	fillOpacity   float64
+	strokeOpacity float64
+	hidden        bool
+}
+
+// child returns the state for a child element with the given attributes.
+func (parent svgState) child(attrs []xml.Attr) svgState {
+	props := svgProperties(attrs)
+	state := parent
+	if value, ok := props["transform"]; ok {
+		state.transform = parent.transform.mul(parseSvgTransform(value))
+	}
+	if value, ok := props["color"]; ok {
+		if c, ok := parseSvgColor(value, parent.color); ok {
+			state.color = c
+		}
+	}
+	if value, ok := props["fill"]; ok {
+		state.fill = parseSvgPaint(value, parent.fill)
+	}
+	if value, ok := props["stroke"]; ok {
+		state.stroke = parseSvgPaint(value, parent.stroke)
+	}
+	if value, ok := props["stroke-width"]; ok {
+		if width, ok := parseSvgNumber(value); ok && width >= 0 {
+			state.strokeWidth = width
+		}
+	}
+	if value, ok := props["stroke-linecap"]; ok {
+		state.lineCap = strings.TrimSpace(value)
+	}
+	if value, ok := props["fill-opacity"]; ok {
+		state.fillOpacity = parseSvgOpacity(value)
+	}
+	if value, ok := props["stroke-opacity"]; ok {
+		state.strokeOpacity = parseSvgOpacity(value)
+	}
+	// Opacity isn't inherited, but applies to everything within the element, so is approximated by
+	// multiplying it into the children.
+	if value, ok := props["opacity"]; ok {
+		state.opacity *= parseSvgOpacity(value)
+	}
+	if strings.TrimSpace(props["display"]) == "none" {
+		state.hidden = true
+	}
+	if value, ok := props["visibility"]; ok {
+		value = strings.TrimSpace(value)
+		state.hidden = state.hidden || value == "hidden" || value == "collapse"
+	}
+	return state
+}
+
+// render draws the SVG image.
+func (renderer *svgRenderer) render(data []byte) error {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+
+	var stack []svgState
+	// skipDepth is the depth within an element which isn't rendered.
+	skipDepth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if stack == nil {
+				return fmt.Errorf("SVG has no root element: %w", err)
+			}
+			// Draw as much as we can of a truncated image.
+			return nil
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			renderer.elements++
+			if renderer.elements > maxSvgElements {
+				return fmt.Errorf("SVG has more than %d elements", maxSvgElements)
+			}
+			// Stylesheets apply even within elements which aren't rendered, but elements from other
+			// namespaces, like metadata, don't matter.
+			if token.Name.Space == "" || token.Name.Space == svgNamespace {
+				if skipDepth == 0 || token.Name.Local == "style" {
+					if feature := svgUnsupportedFeature(token); feature != "" {
+						return fmt.Errorf("SVG uses an unsupported feature: %s", feature)
+					}
+				}
+			}
+			if stack == nil {
+				if token.Name.Local != "svg" {
+					return fmt.Errorf("Root element is %s, not svg", token.Name.Local)
+				}
+				stack = append(stack, renderer.rootState(data).child(token.Attr))
+				continue
+			}
+			if skipDepth > 0 || svgNonRendered[token.Name.Local] {
+				skipDepth++
+				continue
+			}
+			state := stack[len(stack)-1].child(token.Attr)
+			stack = append(stack, state)
+			if state.hidden {
+				continue
+			}
+			if err := renderer.ctx.Err(); err != nil {
+				return err
+			}
+			if err := renderer.drawShape(token, state); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			if skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+			if len(stack) == 0 {
+				return nil
+			}
+		}
+	}
+}
+
+// rootState returns the initial state, transforming the SVG's user space to the output image.
+func (renderer *svgRenderer) rootState(data []byte) svgState {
+	size := renderer.dst.Bounds().Size()
+	width, height := float64(size.X), float64(size.Y)
+
+	// The user space is the viewBox or, if there isn't one, the nominal size.
+	minX, minY := 0.0, 0.0
+	root, _ := svgRoot(data)
+	userWidth, userHeight, ok := svgRootSize(root)
+	if viewBox, hasViewBox := svgViewBox(root); hasViewBox {
+		minX, minY, userWidth, userHeight = viewBox[0], viewBox[1], viewBox[2], viewBox[3]
+	} else if !ok {
+		userWidth, userHeight = width, height
+	}
+
+	// Scale to fit, centred, like the default preserveAspectRatio of "xMidYMid meet".
+	scale := math.Min(width/userWidth, height/userHeight)
+	offsetX := (width - userWidth*scale) / 2
+	offsetY := (height - userHeight*scale) / 2
+	return svgState{
+		transform:     affine{scale, 0, 0, scale, offsetX - minX*scale, offsetY - minY*scale},
+		fill:          svgPaint{kind: svgPaintColor, color: color.NRGBA{A: 0xff}},
+		color:         color.NRGBA{A: 0xff},
+		strokeWidth:   1,
+		lineCap:       "butt",
+		opacity:       1,
+		fillOpacity:   1,
+		strokeOpacity: 1,
+	}
+}
+
+// drawShape fills and strokes the shape of element, if it is one. It returns an error if the SVG
+// draws too much.
+func (renderer *svgRenderer) drawShape(element xml.StartElement, state svgState) error {
+	props := svgProperties(element.Attr)
+	number := func(name string) float64 {
+		value, _ := parseSvgNumber(props[name])
+		return value
+	}
+
+	var path svgPath
+	switch element.Name.Local {
+	case "path":
+		path = parseSvgPathData(props["d"])
+	case "rect":
+		rx, hasRx := parseSvgNumber(props["rx"])
+		ry, hasRy := parseSvgNumber(props["ry"])
+		if !hasRx {
+			rx = ry
+		}
+		if !hasRy {
+			ry = rx
+		}
+		path.rect(number("x"), number("y"), number("width"), number("height"), rx, ry)
+	case "circle":
+		r := number("r")
+		path.ellipse(number("cx"), number("cy"), r, r)
+	case "ellipse":
+		path.ellipse(number("cx"), number("cy"), number("rx"), number("ry"))
+	case "line":
+		path.moveTo(point{number("x1"), number("y1")})
+		path.lineTo(point{number("x2"), number("y2")})
+	case "polyline", "polygon":
+		points := parseSvgNumbers(props["points"])
+		for idx := 0; idx+1 < len(points); idx += 2 {
+			p := point{points[idx], points[idx+1]}
+			if idx == 0 {
+				path.moveTo(p)
+			} else {
+				path.lineTo(p)
+			}
+		}
+		if element.Name.Local == "polygon" {
+			path.close()
+		}
+	default:
+		return nil
+	}
+	if len(path.ops) == 0 {
+		return nil
+	}
+	if err := renderer.addSegments(len(path.ops)); err != nil {
+		return err
+	}
+	device := path.transform(state.transform)
+	if !device.finite() {
+		return nil
+	}
+
+	// Lines have no inside to fill.
+	if fill, ok := renderer.paint(state.fill, state); ok && element.Name.Local != "line" {
+		fill.A = uint8(float64(fill.A) * state.opacity * state.fillOpacity)
+		if err := renderer.fill(device, fill); err != nil {
+			return err
+		}
+	}
+	if stroke, ok := renderer.paint(state.stroke, state); ok && state.strokeWidth > 0 {
+		stroke.A = uint8(float64(stroke.A) * state.opacity * state.strokeOpacity)
+		halfWidth := state.strokeWidth * state.transform.scale() / 2
+		return renderer.stroke(device, halfWidth, state.lineCap, stroke)
+	}
+	return nil
+}
+
+// addSegments counts n more path segments, returning an error if there are now too many.
+func (renderer *svgRenderer) addSegments(n int) error {
+	renderer.segments += n
+	if renderer.segments > maxSvgPathSegments {
+		return fmt.Errorf("SVG has more than %d path segments", maxSvgPathSegments)
+	}
+	return nil
+}
+
+// paint resolves a paint to a color, returning false if nothing should be drawn.
+func (renderer *svgRenderer) paint(paint svgPaint, state svgState) (color.NRGBA, bool) {
+	switch paint.kind {
+	case svgPaintColor:
+		return paint.color, true
+	case svgPaintCurrentColor:
+		return state.color, true
+	}
+	return color.NRGBA{}, false
+}
+
+// fill fills a path, in device coordinates, with a color. It returns an error if the SVG has drawn
+// too many pixels.
+func (renderer *svgRenderer) fill(path svgPath, c color.NRGBA) error {
+	if c.A == 0 {
+		return nil
+	}
+	var bounds boundingBox
+	for _, op := range path.ops {
+		if op.kind == pathClose {
+			continue
+		}
+		bounds.add(op.points[0])
+		if op.kind == pathCubeTo {
+			// The curve is within the hull of its control points.
+			bounds.add(op.points[1])
+			bounds.add(op.points[2])
+		}
+	}
+	r, err := renderer.reset(bounds)
+	if err != nil || r.Empty() {
+		return err
+	}
+	z := &renderer.z
+	// Points are relative to the area being drawn.
+	at := func(p point) (float32, float32) {
+		return float32(p.x - float64(r.Min.X)), float32(p.y - float64(r.Min.Y))
+	}
+	open := false
+	for _, op := range path.ops {
+		switch op.kind {
+		case pathMoveTo:
+			if open {
+				z.ClosePath()
+			}
+			z.MoveTo(at(op.points[0]))
+			open = true
+		case pathLineTo:
+			z.LineTo(at(op.points[0]))
+		case pathCubeTo:
+			x1, y1 := at(op.points[0])
+			x2, y2 := at(op.points[1])
+			x3, y3 := at(op.points[2])
+			z.CubeTo(x1, y1, x2, y2, x3, y3)
+		case pathClose:
+			z.ClosePath()
+			open = false
+		}
+	}
+	if open {
+		z.ClosePath()
+	}
+	renderer.draw(r, c)
+	return nil
+}
+
+// stroke strokes a path, in device coordinates, with a color. It returns an error if the flattened
+// path has too many segments, or the SVG has drawn too many pixels.
+//
+// Each segment of the flattened path is drawn as a quadrilateral, with circles for round joins and
+// caps.
+func (renderer *svgRenderer) stroke(path svgPath, halfWidth float64, lineCap string, c color.NRGBA) error {
+	if c.A == 0 || halfWidth <= 0 {
+		return nil
+	}
+	lines := path.flatten()
+	for _, line := range lines {
+		if err := renderer.addSegments(len(line.points)); err != nil {
+			return err
+		}
+	}
+
+	var polygons [][]point
+	var bounds boundingBox
+	add := func(polygon []point) {
+		polygons = append(polygons, polygon)
+		for _, p := range polygon {
+			bounds.add(p)
+		}
+	}
+	for _, line := range lines {
+		points := line.points
+		if len(points) == 0 {
+			continue
+		}
+		for idx := 0; idx+1 < len(points); idx++ {
+			p0, p1 := points[idx], points[idx+1]
+			dx, dy := p1.x-p0.x, p1.y-p0.y
+			length := math.Hypot(dx, dy)
+			if length == 0 {
+				continue
+			}
+			// Normal to the segment, half the stroke width long.
+			nx, ny := -dy/length*halfWidth, dx/length*halfWidth
+			if !line.closed && lineCap == "square" {
+				// Extend the ends of the line by half the width.
+				ex, ey := dx/length*halfWidth, dy/length*halfWidth
+				if idx == 0 {
+					p0 = point{p0.x - ex, p0.y - ey}
+				}
+				if idx == len(points)-2 {
+					p1 = point{p1.x + ex, p1.y + ey}
+				}
+			}
+			add([]point{
+				{p0.x + nx, p0.y + ny},
+				{p1.x + nx, p1.y + ny},
+				{p1.x - nx, p1.y - ny},
+				{p0.x - nx, p0.y - ny},
+			})
+		}
+		// Round joins, and round caps at the ends of open lines.
+		for idx, p := range points {
+			end := idx == 0 || idx == len(points)-1
+			if !end || line.closed || lineCap == "round" {
+				add(circlePoints(p, halfWidth))
+			}
+		}
+	}
+
+	r, err := renderer.reset(bounds)
+	if err != nil || r.Empty() {
+		return err
+	}
+	for _, polygon := range polygons {
+		addPolygon(&renderer.z, polygon, r.Min)
+	}
+	renderer.draw(r, c)
+	return nil
+}
+
+// boundingBox is the smallest rectangle containing a set of points.
+type boundingBox struct {
+	min, max point
+	// set is true once a point has been added.
+	set bool
+}
+
+// add extends the box to contain p.
+func (box *boundingBox) add(p point) {
+	if !box.set {
+		box.min, box.max, box.set = p, p, true
+		return
+	}
+	box.min = point{math.Min(box.min.x, p.x), math.Min(box.min.y, p.y)}
+	box.max = point{math.Max(box.max.x, p.x), math.Max(box.max.y, p.y)}
+}
+
+// reset prepares the rasterizer to draw within bounds, clipped to the destination image, returning
+// the area to draw, which is empty if there's nothing to draw. It returns an error if the SVG has
+// now drawn too many pixels.
+func (renderer *svgRenderer) reset(bounds boundingBox) (image.Rectangle, error) {
+	if !bounds.set {
+		return image.Rectangle{}, nil
+	}
+	// Clip before converting to integers, so huge coordinates don't overflow.
+	dst := renderer.dst.Bounds()
+	clip := func(v float64, min, max int) int {
+		return int(math.Max(float64(min), math.Min(float64(max), v)))
+	}
+	r := image.Rect(
+		clip(math.Floor(bounds.min.x), dst.Min.X, dst.Max.X),
+		clip(math.Floor(bounds.min.y), dst.Min.Y, dst.Max.Y),
+		clip(math.Ceil(bounds.max.x), dst.Min.X, dst.Max.X),
+		clip(math.Ceil(bounds.max.y), dst.Min.Y, dst.Max.Y),
+	)
+	if r.Empty() {
+		return r, nil
+	}
+	renderer.pixels += r.Dx() * r.Dy()
+	if renderer.pixels > maxSvgDrawnPixels {
+		return image.Rectangle{}, fmt.Errorf("SVG draws more than %d pixels", maxSvgDrawnPixels)
+	}
+	renderer.z.Reset(r.Dx(), r.Dy())
+	return r, nil
+}
+
+// draw composites a color over the area r of the destination, masked by the rasterized path.
+func (renderer *svgRenderer) draw(r image.Rectangle, c color.NRGBA) {
+	renderer.z.DrawOp = draw.Over
+	renderer.z.Draw(renderer.dst, r, image.NewUniform(c), image.Point{})
+}
+
+// addPolygon adds a closed polygon to the rasterizer, relative to origin, always winding in the
+// same direction so that overlapping polygons don't cancel each other out.
+func addPolygon(z *vector.Rasterizer, points []point, origin image.Point) {
+	area := 0.0
+	for idx, p := range points {
+		q := points[(idx+1)%len(points)]
+		area += p.x*q.y - q.x*p.y
+	}
+	if area < 0 {
+		reversed := make([]point, len(points))
+		for idx, p := range points {
+			reversed[len(points)-1-idx] = p
+		}
+		points = reversed
+	}
+	ox, oy := float64(origin.X), float64(origin.Y)
+	z.MoveTo(float32(points[0].x-ox), float32(points[0].y-oy))
+	for _, p := range points[1:] {
+		z.LineTo(float32(p.x-ox), float32(p.y-oy))
+	}
+	z.ClosePath()
+}
+
+// circlePoints returns a polygon approximating a circle.
+func circlePoints(center point, radius float64) []point {
+	n := int(radius * 2)
+	if n < 12 {
+		n = 12
+	} else if n > 64 {
+		n = 64
+	}
+	points := make([]point, n)
+	for idx := range points {
+		angle := 2 * math.Pi * float64(idx) / float64(n)
+		points[idx] = point{center.x + radius*math.Cos(angle), center.y + radius*math.Sin(angle)}
+	}
+	return points
+}
+
+// point is a point in 2D space.
+type point struct {
+	x, y float64
+}
+
+// affine is an affine transform, as the matrix [a c e; b d f; 0 0 1] in the order (a, b, c, d, e,
+// f) used by SVG.
+type affine [6]float64
+
+// identity is the transform which doesn't change anything.
+var identity = affine{1, 0, 0, 1, 0, 0}
+
+// apply transforms p.
+func (m affine) apply(p point) point {
+	return point{m[0]*p.x + m[2]*p.y + m[4], m[1]*p.x + m[3]*p.y + m[5]}
+}
+
+// mul returns the transform applying n, then m.
+func (m affine) mul(n affine) affine {
+	return affine{
+		m[0]*n[0] + m[2]*n[1],
+		m[1]*n[0] + m[3]*n[1],
+		m[0]*n[2] + m[2]*n[3],
+		m[1]*n[2] + m[3]*n[3],
+		m[0]*n[4] + m[2]*n[5] + m[4],
+		m[1]*n[4] + m[3]*n[5] + m[5],
+	}
+}
+
+// scale returns the average factor lengths are scaled by.
+func (m affine) scale() float64 {
+	return math.Sqrt(math.Abs(m[0]*m[3] - m[1]*m[2]))
+}
+
+// parseSvgTransform parses the value of a transform attribute. Invalid transforms are ignored.
+func parseSvgTransform(value string) affine {
+	result := identity
+	for {
+		open := strings.IndexByte(value, '(')
+		close := strings.IndexByte(value, ')')
+		if open < 0 || close < open {
+			return result
+		}
+		name := strings.Trim(value[:open], " \t\r\n,")
+		args := parseSvgNumbers(value[open+1 : close])
+		value = value[close+1:]
+
+		var m affine
+		switch {
+		case name == "matrix" && len(args) == 6:
+			m = affine{args[0], args[1], args[2], args[3], args[4], args[5]}
+		case name == "translate" && len(args) == 1:
+			m = affine{1, 0, 0, 1, args[0], 0}
+		case name == "translate" && len(args) == 2:
+			m = affine{1, 0, 0, 1, args[0], args[1]}
+		case name == "scale" && len(args) == 1:
+			m = affine{args[0], 0, 0, args[0], 0, 0}
+		case name == "scale" && len(args) == 2:
+			m = affine{args[0], 0, 0, args[1], 0, 0}
+		case name == "rotate" && (len(args) == 1 || len(args) == 3):
+			angle := args[0] * math.Pi / 180
+			sin, cos := math.Sincos(angle)
+			m = affine{cos, sin, -sin, cos, 0, 0}
+			if len(args) == 3 {
+				cx, cy := args[1], args[2]
+				m = affine{1, 0, 0, 1, cx, cy}.mul(m).mul(affine{1, 0, 0, 1, -cx, -cy})
+			}
+		case name == "skewX" && len(args) == 1:
+			m = affine{1, 0, math.Tan(args[0] * math.Pi / 180), 1, 0, 0}
+		case name == "skewY" && len(args) == 1:
+			m = affine{1, math.Tan(args[0] * math.Pi / 180), 0, 1, 0, 0}
+		default:
+			continue
+		}
+		result = result.mul(m)
+	}
+}
+
+// svgProperties returns the presentation attributes and style properties of an element, with the
+// style taking precedence. Namespaces are ignored.
+func svgProperties(attrs []xml.Attr) map[string]string {
+	props := make(map[string]string, len(attrs))
+	for _, attr := range attrs {
+		props[attr.Name.Local] = attr.Value
+	}
+	for _, declaration := range strings.Split(props["style"], ";") {
+		name, value, ok := strings.Cut(declaration, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "!important"))
+		props[strings.TrimSpace(name)] = value
+	}
+	return props
+}
+
+// parseSvgPaint parses a fill or stroke value, returning inherited if it's "inherit" or invalid.
+func parseSvgPaint(value string, inherited svgPaint) svgPaint {
+	value = strings.TrimSpace(value)
+	switch value {
+	case "none", "transparent":
+		return svgPaint{kind: svgPaintNone}
+	case "currentColor", "currentcolor":
+		return svgPaint{kind: svgPaintCurrentColor}
+	case "inherit", "":
+		return inherited
+	}
+	if c, ok := parseSvgColor(value, color.NRGBA{}); ok {
+		return svgPaint{kind: svgPaintColor, color: c}
+	}
+	return inherited
+}
+
+// parseSvgOpacity parses an opacity, as a number or percentage, clamped between 0 and 1. Invalid
+// values are fully opaque.
+func parseSvgOpacity(value string) float64 {
+	value = strings.TrimSpace(value)
+	scale := 1.0
+	if strings.HasSuffix(value, "%") {
+		value, scale = strings.TrimSuffix(value, "%"), 0.01
+	}
+	opacity, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(opacity) {
+		return 1
+	}
+	return math.Max(0, math.Min(1, opacity*scale))
+}
+
+// svgColors are the CSS named colors most likely to appear in icons.
+var svgColors = map[string]color.NRGBA{
+	"black":      {0x00, 0x00, 0x00, 0xff},
+	"silver":     {0xc0, 0xc0, 0xc0, 0xff},
+	"gray":       {0x80, 0x80, 0x80, 0xff},
+	"grey":       {0x80, 0x80, 0x80, 0xff},
+	"white":      {0xff, 0xff, 0xff, 0xff},
+	"maroon":     {0x80, 0x00, 0x00, 0xff},
+	"red":        {0xff, 0x00, 0x00, 0xff},
+	"purple":     {0x80, 0x00, 0x80, 0xff},
+	"fuchsia":    {0xff, 0x00, 0xff, 0xff},
+	"magenta":    {0xff, 0x00, 0xff, 0xff},
+	"green":      {0x00, 0x80, 0x00, 0xff},
+	"lime":       {0x00, 0xff, 0x00, 0xff},
+	"olive":      {0x80, 0x80, 0x00, 0xff},
+	"yellow":     {0xff, 0xff, 0x00, 0xff},
+	"navy":       {0x00, 0x00, 0x80, 0xff},
+	"blue":       {0x00, 0x00, 0xff, 0xff},
+	"teal":       {0x00, 0x80, 0x80, 0xff},
+	"aqua":       {0x00, 0xff, 0xff, 0xff},
+	"cyan":       {0x00, 0xff, 0xff, 0xff},
+	"orange":     {0xff, 0xa5, 0x00, 0xff},
+	"gold":       {0xff, 0xd7, 0x00, 0xff},
+	"pink":       {0xff, 0xc0, 0xcb, 0xff},
+	"brown":      {0xa5, 0x2a, 0x2a, 0xff},
+	"darkgray":   {0xa9, 0xa9, 0xa9, 0xff},
+	"darkgrey":   {0xa9, 0xa9, 0xa9, 0xff},
+	"lightgray":  {0xd3, 0xd3, 0xd3, 0xff},
+	"lightgrey":  {0xd3, 0xd3, 0xd3, 0xff},
+	"dimgray":    {0x69, 0x69, 0x69, 0xff},
+	"dimgrey":    {0x69, 0x69, 0x69, 0xff},
+	"darkblue":   {0x00, 0x00, 0x8b, 0xff},
+	"darkgreen":  {0x00, 0x64, 0x00, 0xff},
+	"darkred":    {0x8b, 0x00, 0x00, 0xff},
+	"indigo":     {0x4b, 0x00, 0x82, 0xff},
+	"violet":     {0xee, 0x82, 0xee, 0xff},
+	"royalblue":  {0x41, 0x69, 0xe1, 0xff},
+	"steelblue":  {0x46, 0x82, 0xb4, 0xff},
+	"tomato":     {0xff, 0x63, 0x47, 0xff},
+	"crimson":    {0xdc, 0x14, 0x3c, 0xff},
+	"coral":      {0xff, 0x7f, 0x50, 0xff},
+	"salmon":     {0xfa, 0x80, 0x72, 0xff},
+	"skyblue":    {0x87, 0xce, 0xeb, 0xff},
+	"turquoise":  {0x40, 0xe0, 0xd0, 0xff},
+	"whitesmoke": {0xf5, 0xf5, 0xf5, 0xff},
+}
+
+// parseSvgColor parses a CSS color: a hex color, rgb() or rgba(), or a named color. It returns
+// current for "currentColor", and false if the color is invalid.
+func parseSvgColor(value string, current color.NRGBA) (color.NRGBA, bool) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "currentcolor" {
+		return current, true
+	}
+	if c, ok := svgColors[value]; ok {
+		return c, true
+	}
+	if strings.HasPrefix(value, "#") {
+		hex := value[1:]
+		if len(hex) == 3 || len(hex) == 4 {
+			// Expand the short form.
+			var expanded strings.Builder
+			for _, digit := range hex {
+				expanded.WriteRune(digit)
+				expanded.WriteRune(digit)
+			}
+			hex = expanded.String()
+		}
+		if len(hex) == 6 {
+			hex += "ff"
+		}
+		n, err := strconv.ParseUint(hex, 16, 32)
+		if len(hex) != 8 || err != nil {
+			return color.NRGBA{}, false
+		}
+		return color.NRGBA{uint8(n >> 24), uint8(n >> 16), uint8(n >> 8), uint8(n)}, true
+	}
+	if strings.HasPrefix(value, "rgb(") || strings.HasPrefix(value, "rgba(") {
+		start := strings.IndexByte(value, '(')
+		end := strings.IndexByte(value, ')')
+		if end < start {
+			return color.NRGBA{}, false
+		}
+		args := strings.FieldsFunc(value[start+1:end], func(r rune) bool {
+			return r == ',' || r == ' ' || r == '/'
+		})
+		if len(args) != 3 && len(args) != 4 {
+			return color.NRGBA{}, false
+		}
+		var channels [4]uint8
+		channels[3] = 0xff
+		for idx, arg := range args {
+			var channel float64
+			if idx == 3 {
+				channel = parseSvgOpacity(arg) * 255
+			} else if strings.HasSuffix(arg, "%") {
+				percent, err := strconv.ParseFloat(strings.TrimSuffix(arg, "%"), 64)
+				if err != nil {
+					return color.NRGBA{}, false
+				}
+				channel = percent * 255 / 100
+			} else {
+				var err error
+				channel, err = strconv.ParseFloat(arg, 64)
+				if err != nil {
+					return color.NRGBA{}, false
+				}
+			}
+			channels[idx] = uint8(math.Round(math.Max(0, math.Min(255, channel))))
+		}
+		return color.NRGBA{channels[0], channels[1], channels[2], channels[3]}, true
+	}
+	return color.NRGBA{}, false
+}
+
+// pathOpKind is the kind of a path operation.
+type pathOpKind int
+
+const (
+	pathMoveTo pathOpKind = iota
+	pathLineTo
+	pathCubeTo
+	pathClose
+)
+
+// pathOp is an operation of a path. Quadratic curves and arcs are converted to cubic curves.
+type pathOp struct {
+	kind pathOpKind
+	// points are the end point, or for cubic curves, the two control points then the end point.
+	points [3]point
+}
+
+// svgPath is a path made up of subpaths.
+type svgPath struct {
+	ops []pathOp
+	// start of the current subpath, and the current point.
+	start, current point
+}
+
+func (path *svgPath) moveTo(p point) {
+	path.ops = append(path.ops, pathOp{kind: pathMoveTo, points: [3]point{p}})
+	path.start, path.current = p, p
+}
+
+func (path *svgPath) lineTo(p point) {
+	if len(path.ops) == 0 {
+		path.moveTo(path.current)
+	}
+	path.ops = append(path.ops, pathOp{kind: pathLineTo, points: [3]point{p}})
+	path.current = p
+}
+
+func (path *svgPath) cubeTo(c1, c2, p point) {
+	if len(path.ops) == 0 {
+		path.moveTo(path.current)
+	}
+	path.ops = append(path.ops, pathOp{kind: pathCubeTo, points: [3]point{c1, c2, p}})
+	path.current = p
+}
+
+// quadTo adds a quadratic curve, as the equivalent cubic curve.
+func (path *svgPath) quadTo(c, p point) {
+	p0 := path.current
+	path.cubeTo(
+		point{p0.x + 2.0/3*(c.x-p0.x), p0.y + 2.0/3*(c.y-p0.y)},
+		point{p.x + 2.0/3*(c.x-p.x), p.y + 2.0/3*(c.y-p.y)},
+		p,
+	)
+}
+
+func (path *svgPath) close() {
+	if len(path.ops) == 0 {
+		return
+	}
+	path.ops = append(path.ops, pathOp{kind: pathClose})
+	path.current = path.start
+}
+
+// arcTo adds an elliptical arc, as in SVG path data, approximated by cubic curves.
+//
+// The conversion follows https://www.w3.org/TR/SVG11/implnote.html#ArcImplementationNotes.
+func (path *svgPath) arcTo(rx, ry, rotation float64, largeArc, sweep bool, p point) {
+	p0 := path.current
+	if p0 == p {
+		return
+	}
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if rx == 0 || ry == 0 {
+		path.lineTo(p)
+		return
+	}
+	sinPhi, cosPhi := math.Sincos(rotation * math.Pi / 180)
+
+	// Step 1: compute (x1', y1').
+	dx2, dy2 := (p0.x-p.x)/2, (p0.y-p.y)/2
+	x1 := cosPhi*dx2 + sinPhi*dy2
+	y1 := -sinPhi*dx2 + cosPhi*dy2
+
+	// Scale up the radii if they're too small to reach the end point.
+	if lambda := x1*x1/(rx*rx) + y1*y1/(ry*ry); lambda > 1 {
+		rx, ry = rx*math.Sqrt(lambda), ry*math.Sqrt(lambda)
+	}
+
+	// Step 2: compute (cx', cy').
+	numerator := rx*rx*ry*ry - rx*rx*y1*y1 - ry*ry*x1*x1
+	denominator := rx*rx*y1*y1 + ry*ry*x1*x1
+	coef := math.Sqrt(math.Max(0, numerator/denominator))
+	if largeArc == sweep {
+		coef = -coef
+	}
+	cx1, cy1 := coef*rx*y1/ry, -coef*ry*x1/rx
+
+	// Step 3: compute (cx, cy).
+	cx := cosPhi*cx1 - sinPhi*cy1 + (p0.x+p.x)/2
+	cy := sinPhi*cx1 + cosPhi*cy1 + (p0.y+p.y)/2
+
+	// Step 4: compute the start angle and its extent.
+	angle := func(ux, uy, vx, vy float64) float64 {
+		return math.Atan2(ux*vy-uy*vx, ux*vx+uy*vy)
+	}
+	theta := angle(1, 0, (x1-cx1)/rx, (y1-cy1)/ry)
+	delta := angle((x1-cx1)/rx, (y1-cy1)/ry, (-x1-cx1)/rx, (-y1-cy1)/ry)
+	if !sweep && delta > 0 {
+		delta -= 2 * math.Pi
+	} else if sweep && delta < 0 {
+		delta += 2 * math.Pi
+	}
+
+	// Split into segments of at most a quarter turn, each approximated by a cubic curve.
+	segments := int(math.Ceil(math.Abs(delta) / (math.Pi / 2)))
+	if segments == 0 {
+		return
+	}
+	step := delta / float64(segments)
+	k := 4.0 / 3 * math.Tan(step/4)
+	ellipse := func(a float64) (p, d point) {
+		sin, cos := math.Sincos(a)
+		p = point{cx + rx*cos*cosPhi - ry*sin*sinPhi, cy + rx*cos*sinPhi + ry*sin*cosPhi}
+		d = point{-rx*sin*cosPhi - ry*cos*sinPhi, -rx*sin*sinPhi + ry*cos*cosPhi}
+		return p, d
+	}
+	for idx := 0; idx < segments; idx++ {
+		a1 := theta + float64(idx)*step
+		start, startD := ellipse(a1)
+		end, endD := ellipse(a1 + step)
+		if idx == segments-1 {
+			// Avoid accumulating rounding errors at the end point.
+			end = p
+		}
+		path.cubeTo(
+			point{start.x + k*startD.x, start.y + k*startD.y},
+			point{end.x - k*endD.x, end.y - k*endD.y},
+			end,
+		)
+	}
+}
+
+// rect adds a rectangle, with rounded corners if rx and ry are positive.
+func (path *svgPath) rect(x, y, width, height, rx, ry float64) {
+	if width <= 0 || height <= 0 {
+		return
+	}
+	rx = math.Max(0, math.Min(rx, width/2))
+	ry = math.Max(0, math.Min(ry, height/2))
+	if rx == 0 || ry == 0 {
+		path.moveTo(point{x, y})
+		path.lineTo(point{x + width, y})
+		path.lineTo(point{x + width, y + height})
+		path.lineTo(point{x, y + height})
+		path.close()
+		return
+	}
+	path.moveTo(point{x + rx, y})
+	path.lineTo(point{x + width - rx, y})
+	path.arcTo(rx, ry, 0, false, true, point{x + width, y + ry})
+	path.lineTo(point{x + width, y + height - ry})
+	path.arcTo(rx, ry, 0, false, true, point{x + width - rx, y + height})
+	path.lineTo(point{x + rx, y + height})
+	path.arcTo(rx, ry, 0, false, true, point{x, y + height - ry})
+	path.lineTo(point{x, y + ry})
+	path.arcTo(rx, ry, 0, false, true, point{x + rx, y})
+	path.close()
+}
+
+// ellipse adds an ellipse.
+func (path *svgPath) ellipse(cx, cy, rx, ry float64) {
+	if rx <= 0 || ry <= 0 {
+		return
+	}
+	path.moveTo(point{cx + rx, cy})
+	path.arcTo(rx, ry, 0, false, true, point{cx, cy + ry})
+	path.arcTo(rx, ry, 0, false, true, point{cx - rx, cy})
+	path.arcTo(rx, ry, 0, false, true, point{cx, cy - ry})
+	path.arcTo(rx, ry, 0, false, true, point{cx + rx, cy})
+	path.close()
+}
+
+// transform returns the path with every point transformed by m.
+func (path svgPath) transform(m affine) svgPath {
+	transformed := svgPath{ops: make([]pathOp, len(path.ops))}
+	for idx, op := range path.ops {
+		for pointIdx := range op.points {
+			op.points[pointIdx] = m.apply(op.points[pointIdx])
+		}
+		transformed.ops[idx] = op
+	}
+	return transformed
+}
+
+// finite returns true if every point of the path is finite.
+func (path svgPath) finite() bool {
+	for _, op := range path.ops {
+		for _, p := range op.points {
+			if math.IsNaN(p.x) || math.IsNaN(p.y) || math.IsInf(p.x, 0) || math.IsInf(p.y, 0) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// polyline is a subpath flattened to straight lines.
+type polyline struct {
+	points []point
+	closed bool
+}
+
+// flatten converts the path to polylines, approximating curves with straight lines.
+func (path svgPath) flatten() []polyline {
+	var lines []polyline
+	var current point
+	for _, op := range path.ops {
+		switch op.kind {
+		case pathMoveTo:
+			current = op.points[0]
+			lines = append(lines, polyline{points: []point{current}})
+			continue
+		case pathClose:
+			if len(lines) > 0 {
+				line := &lines[len(lines)-1]
+				line.closed = true
+				first := line.points[0]
+				if line.points[len(line.points)-1] != first {
+					line.points = append(line.points, first)
+				}
+				current = first
+				// Anything drawn after closing starts a new subpath from the same point.
+				lines = append(lines, polyline{points: []point{current}})
+			}
+			continue
+		}
+		if len(lines) == 0 {
+			lines = append(lines, polyline{points: []point{current}})
+		}
+		line := &lines[len(lines)-1]
+		switch op.kind {
+		case pathLineTo:
+			line.points = append(line.points, op.points[0])
+		case pathCubeTo:
+			c1, c2, end := op.points[0], op.points[1], op.points[2]
+			// Use more segments for longer curves.
+			length := math.Hypot(c1.x-current.x, c1.y-current.y) +
+				math.Hypot(c2.x-c1.x, c2.y-c1.y) +
+				math.Hypot(end.x-c2.x, end.y-c2.y)
+			segments := int(math.Min(64, math.Max(1, length/2)))
+			for idx := 1; idx <= segments; idx++ {
+				t := float64(idx) / float64(segments)
+				mt := 1 - t
+				line.points = append(line.points, point{
+					mt*mt*mt*current.x + 3*mt*mt*t*c1.x + 3*mt*t*t*c2.x + t*t*t*end.x,
+					mt*mt*mt*current.y + 3*mt*mt*t*c1.y + 3*mt*t*t*c2.y + t*t*t*end.y,
+				})
+			}
+		}
+		current = line.points[len(line.points)-1]
+	}
+	return lines
+}
+
+// svgPathScanner reads the commands and numbers of SVG path data.
+type svgPathScanner struct {
+	data string
+	pos  int
+}
+
+// skipSeparators skips whitespace and commas.
+func (scanner *svgPathScanner) skipSeparators() {
+	for scanner.pos < len(scanner.data) {
+		switch scanner.data[scanner.pos] {
+		case ' ', '\t', '\r', '\n', ',':
+			scanner.pos++
+		default:
+			return
+		}
+	}
+}
+
+// command returns the next command letter, or false if the next token isn't one.
+func (scanner *svgPathScanner) command() (byte, bool) {
+	scanner.skipSeparators()
+	if scanner.pos >= len(scanner.data) {
+		return 0, false
+	}
+	c := scanner.data[scanner.pos]
+	if (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') && c != 'e' && c != 'E' {
+		scanner.pos++
+		return c, true
+	}
+	return 0, false
+}
+
+// number returns the next number, or false if the next token isn't one.
+func (scanner *svgPathScanner) number() (float64, bool) {
+	scanner.skipSeparators()
+	start := scanner.pos
+	pos := start
+	data := scanner.data
+	if pos < len(data) && (data[pos] == '+' || data[pos] == '-') {
+		pos++
+	}
+	digits := 0
+	for pos < len(data) && data[pos] >= '0' && data[pos] <= '9' {
+		pos++
+		digits++
+	}
+	if pos < len(data) && data[pos] == '.' {
+		pos++
+		for pos < len(data) && data[pos] >= '0' && data[pos] <= '9' {
+			pos++
+			digits++
+		}
+	}
+	if digits == 0 {
+		return 0, false
+	}
+	if pos < len(data) && (data[pos] == 'e' || data[pos] == 'E') {
+		exp := pos + 1
+		if exp < len(data) && (data[exp] == '+' || data[exp] == '-') {
+			exp++
+		}
+		if exp < len(data) && data[exp] >= '0' && data[exp] <= '9' {
+			pos = exp
+			for pos < len(data) && data[pos] >= '0' && data[pos] <= '9' {
+				pos++
+			}
+		}
+	}
+	value, err := strconv.ParseFloat(data[start:pos], 64)
+	if err != nil {
+		return 0, false
+	}
+	scanner.pos = pos
+	return value, true
+}
+
+// flag returns the next arc flag, which may not be separated from the following number.
+func (scanner *svgPathScanner) flag() (bool, bool) {
+	scanner.skipSeparators()
+	if scanner.pos >= len(scanner.data) {
+		return false, false
+	}
+	switch scanner.data[scanner.pos] {
+	case '0':
+		scanner.pos++
+		return false, true
+	case '1':
+		scanner.pos++
+		return true, true
+	}
+	return false, false
+}
+
+// numbers reads n numbers, returning false if there aren't enough.
+func (scanner *svgPathScanner) numbers(n int) ([]float64, bool) {
+	values := make([]float64, n)
+	for idx := range values {
+		value, ok := scanner.number()
+		if !ok {
+			return nil, false
+		}
+		values[idx] = value
+	}
+	return values, true
+}
+
+// parseSvgPathData parses the d attribute of a path. As the SVG specification requires, everything
+// up to the first error is drawn.
+func parseSvgPathData(data string) svgPath {
+	var path svgPath
+	scanner := svgPathScanner{data: data}
+	var command byte
+	// lastControl is the second control point of the previous curve, for smooth curves.
+	var lastControl point
+	var lastCommand byte
+	for {
+		if next, ok := scanner.command(); ok {
+			command = next
+		} else if command == 0 || scanner.pos >= len(scanner.data) {
+			return path
+		}
+		// Z takes no arguments, so must not repeat.
+		if command == 'z' || command == 'Z' {
+			path.close()
+			lastCommand, command = 'z', 0
+			continue
+		}
+
+		relative := command >= 'a'
+		origin := point{}
+		if relative {
+			origin = path.current
+		}
+		abs := func(x, y float64) point {
+			return point{origin.x + x, origin.y + y}
+		}
+		// reflect returns the reflection of the last control point if the previous command was one
+		// of the given curves, otherwise the current point.
+		reflect := func(curves string) point {
+			if strings.IndexByte(curves, lastCommand|0x20) >= 0 {
+				return point{2*path.current.x - lastControl.x, 2*path.current.y - lastControl.y}
+			}
+			return path.current
+		}
+
+		var ok bool
+		switch command | 0x20 {
+		case 'm':
+			var args []float64
+			if args, ok = scanner.numbers(2); ok {
+				path.moveTo(abs(args[0], args[1]))
+				// Following coordinates are line commands.
+				if relative {
+					command = 'l'
+				} else {
+					command = 'L'
+				}
+				lastCommand = 'm'
+				continue
+			}
+		case 'l':
+			var args []float64
+			if args, ok = scanner.numbers(2); ok {
+				path.lineTo(abs(args[0], args[1]))
+			}
+		case 'h':
+			var x float64
+			if x, ok = scanner.number(); ok {
+				if relative {
+					x += path.current.x
+				}
+				path.lineTo(point{x, path.current.y})
+			}
+		case 'v':
+			var y float64
+			if y, ok = scanner.number(); ok {
+				if relative {
+					y += path.current.y
+				}
+				path.lineTo(point{path.current.x, y})
+			}
+		case 'c':
+			var args []float64
+			if args, ok = scanner.numbers(6); ok {
+				c1, c2 := abs(args[0], args[1]), abs(args[2], args[3])
+				path.cubeTo(c1, c2, abs(args[4], args[5]))
+				lastControl = c2
+			}
+		case 's':
+			var args []float64
+			if args, ok = scanner.numbers(4); ok {
+				c1, c2 := reflect("cs"), abs(args[0], args[1])
+				path.cubeTo(c1, c2, abs(args[2], args[3]))
+				lastControl = c2
+			}
+		case 'q':
+			var args []float64
+			if args, ok = scanner.numbers(4); ok {
+				c := abs(args[0], args[1])
+				path.quadTo(c, abs(args[2], args[3]))
+				lastControl = c
+			}
+		case 't':
+			var args []float64
+			if args, ok = scanner.numbers(2); ok {
+				c := reflect("qt")
+				path.quadTo(c, abs(args[0], args[1]))
+				lastControl = c
+			}
+		case 'a':
+			var radii []float64
+			var largeArc, sweep bool
+			radii, ok = scanner.numbers(3)
+			if ok {
+				largeArc, ok = scanner.flag()
+			}
+			if ok {
+				sweep, ok = scanner.flag()
+			}
+			var end []float64
+			if ok {
+				end, ok = scanner.numbers(2)
+			}
+			if ok {
+				path.arcTo(radii[0], radii[1], radii[2], largeArc, sweep, abs(end[0], end[1]))
+			}
+		}
+		if !ok {
+			return path
+		}
+		lastCommand = command
+	}
+}
+
+// parseSvgNumbers parses a list of numbers separated by whitespace or commas, stopping at the first
+// invalid number.
+func parseSvgNumbers(value string) []float64 {
+	scanner := svgPathScanner{data: value}
+	var numbers []float64
+	for {
+		number, ok := scanner.number()
+		if !ok {
+			return numbers
+		}
+		numbers = append(numbers, number)
+	}
+}
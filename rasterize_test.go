@@ -0,0 +1,268 @@
+package iconscraper
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRasterizeSvg(t *testing.T) {
+	const (
+		red         = "ff0000ff"
+		green       = "00ff00ff"
+		blue        = "0000ffff"
+		black       = "000000ff"
+		transparent = "00000000"
+	)
+	tests := []struct {
+		name   string
+		svg    string
+		pixels map[image.Point]string
+	}{
+		{
+			"rect",
+			`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24"><rect x="6" y="6" width="12" height="12" fill="red"/></svg>`,
+			map[image.Point]string{{32, 32}: red, {4, 4}: transparent, {60, 60}: transparent},
+		},
+		{
+			"circle scaled to fit",
+			`<svg width="48" height="24"><circle cx="24" cy="12" r="12" fill="#00f"/></svg>`,
+			map[image.Point]string{{32, 32}: blue, {32, 4}: transparent, {6, 6}: transparent},
+		},
+		{
+			"path with transform",
+			`<svg viewBox="0 0 24 24"><g transform="translate(12 0)"><path d="M0 0h12v24H0z" style="fill: rgb(0, 255, 0)"/></g></svg>`,
+			map[image.Point]string{{48, 32}: green, {16, 32}: transparent},
+		},
+		{
+			"arcs",
+			`<svg viewBox="0 0 24 24"><path d="M2 12a10 10 0 1 1 20 0a10 10 0 0 1-20 0" fill="currentColor" color="blue"/></svg>`,
+			map[image.Point]string{{32, 32}: blue, {32, 8}: blue, {2, 2}: transparent},
+		},
+		{
+			"stroke",
+			`<svg viewBox="0 0 24 24"><polyline points="0,12 24,12" fill="none" stroke="black" stroke-width="4"/></svg>`,
+			map[image.Point]string{{32, 32}: black, {0, 32}: black, {32, 20}: transparent},
+		},
+		{
+			"unused definitions",
+			`<svg viewBox="0 0 24 24"><defs><linearGradient id="g"><stop offset="0" stop-color="#0000ff"/></linearGradient><clipPath id="c"><text>a</text></clipPath></defs><rect width="24" height="24" fill="red"/></svg>`,
+			map[image.Point]string{{32, 32}: red},
+		},
+		{
+			"hidden and opacity",
+			`<svg viewBox="0 0 24 24"><rect width="24" height="24" fill="red" display="none"/><g opacity="0.5"><rect width="12" height="24" fill="#000"/></g></svg>`,
+			map[image.Point]string{{16, 32}: "0000007f", {48, 32}: transparent},
+		},
+		{
+			"partly outside",
+			`<svg viewBox="0 0 24 24"><rect x="-12" y="-12" width="24" height="48" fill="red"/></svg>`,
+			map[image.Point]string{{16, 32}: red, {48, 32}: transparent},
+		},
+		{
+			"truncated",
+			`<svg viewBox="0 0 24 24"><rect width="24" height="24" fill="red"/><rect`,
+			map[image.Point]string{{32, 32}: red},
+		},
+	}
+	for _, test := range tests {
+		img, err := rasterizeSvg(context.Background(), []byte(test.svg), 64, 64)
+		if err != nil {
+			t.Error(test.name, err)
+			continue
+		}
+		for p, expected := range test.pixels {
+			c := color.NRGBAModel.Convert(img.At(p.X, p.Y)).(color.NRGBA)
+			if got := hexColor(c); got != expected {
+				t.Errorf("%s: expected %s at %v, got %s", test.name, expected, p, got)
+			}
+		}
+	}
+
+	if _, err := rasterizeSvg(context.Background(), []byte(`<html></html>`), 64, 64); err == nil {
+		t.Error("expected an error for a document that isn't an SVG")
+	}
+}
+
+func TestRasterizeSvgUnsupported(t *testing.T) {
+	// Each of these would be drawn wrongly, so mustn't be drawn at all.
+	tests := map[string]string{
+		"evenodd":    `<svg viewBox="0 0 24 24"><path fill-rule="evenodd" d="M0 0h24v24H0z M6 6h12v12H6z" fill="red"/></svg>`,
+		"use":        `<svg viewBox="0 0 24 24" xmlns:xlink="http://www.w3.org/1999/xlink"><defs><rect id="r" width="24" height="24" fill="red"/></defs><use xlink:href="#r"/></svg>`,
+		"clip-path":  `<svg viewBox="0 0 24 24"><defs><clipPath id="c"><rect width="12" height="12"/></clipPath></defs><rect width="24" height="24" fill="red" clip-path="url(#c)"/></svg>`,
+		"mask":       `<svg viewBox="0 0 24 24"><defs><mask id="m"><rect width="12" height="12" fill="white"/></mask></defs><rect width="24" height="24" fill="red" style="mask: url(#m)"/></svg>`,
+		"gradient":   `<svg viewBox="0 0 24 24"><defs><linearGradient id="g"><stop offset="0" stop-color="#ff0000"/><stop offset="1" stop-color="#0000ff"/></linearGradient></defs><rect width="24" height="24" fill="url(#g)"/></svg>`,
+		"stylesheet": `<svg viewBox="0 0 24 24"><defs><style>rect { fill: blue }</style></defs><rect width="24" height="24" fill="red"/></svg>`,
+		"text":       `<svg viewBox="0 0 24 24"><text x="0" y="20" font-size="20">A</text></svg>`,
+		"inherited":  `<svg viewBox="0 0 24 24" fill-rule="evenodd"><path d="M0 0h24v24H0z M6 6h12v12H6z" fill="red"/></svg>`,
+	}
+	for name, svg := range tests {
+		if _, err := rasterizeSvg(context.Background(), []byte(svg), 64, 64); err == nil {
+			t.Error(name, "expected an error for an unsupported feature")
+		}
+	}
+}
+
+func TestRasterizeSvgLimits(t *testing.T) {
+	// Lots of tiny shapes on a large canvas should each only cost their own area.
+	shapes := func(n int) []byte {
+		svg := []byte(`<svg viewBox="0 0 100 100">`)
+		for idx := 0; idx < n; idx++ {
+			svg = append(svg, fmt.Sprintf(`<rect x="%d" y="%d" width="1" height="1" fill="red"/>`, idx%100, idx/100%100)...)
+		}
+		return append(svg, "</svg>"...)
+	}
+	start := time.Now()
+	img, err := rasterizeSvg(context.Background(), shapes(maxSvgElements-1), 1024, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Error("expected a large number of small shapes to be drawn quickly, took", elapsed)
+	}
+	if c := color.NRGBAModel.Convert(img.At(5, 5)).(color.NRGBA); hexColor(c) != "ff0000ff" {
+		t.Error("expected the shapes to be drawn, got", c)
+	}
+
+	if _, err := rasterizeSvg(context.Background(), shapes(20000), 1024, 1024); err == nil {
+		t.Error("expected an error for too many elements")
+	}
+	layers := `<svg viewBox="0 0 100 100">` + strings.Repeat(`<rect width="100" height="100"/>`, 1000) + `</svg>`
+	if _, err := rasterizeSvg(context.Background(), []byte(layers), 1024, 1024); err == nil {
+		t.Error("expected an error for drawing too many pixels")
+	}
+	long := `<svg viewBox="0 0 100 100"><path d="M0 0` + strings.Repeat(" L1 1", maxSvgPathSegments) + `"/></svg>`
+	if _, err := rasterizeSvg(context.Background(), []byte(long), 64, 64); err == nil {
+		t.Error("expected an error for too many path segments")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := rasterizeSvg(ctx, shapes(10), 64, 64); err != context.Canceled {
+		t.Error("expected the context's error, got", err)
+	}
+}
+
+// hexColor formats a color as hex, with each channel within 1 of a multiple of 0x7f rounded, so
+// antialiasing and rounding don't matter.
+func hexColor(c color.NRGBA) string {
+	round := func(v uint8) uint8 {
+		switch {
+		case v >= 0xfe:
+			return 0xff
+		case v >= 0x7e && v <= 0x80:
+			return 0x7f
+		case v <= 1:
+			return 0
+		}
+		return v
+	}
+	const digits = "0123456789abcdef"
+	var out []byte
+	for _, v := range []uint8{round(c.R), round(c.G), round(c.B), round(c.A)} {
+		out = append(out, digits[v>>4], digits[v&0xf])
+	}
+	if c.A == 0 {
+		return "00000000"
+	}
+	return string(out)
+}
+
+func TestParseSvgPathData(t *testing.T) {
+	path := parseSvgPathData("M10-5.5l1e1,0 2 2zm1 1 2 2c1 1 2 2 3 3s1 1 2 2q1 1 2 2t3 3H0V0")
+	kinds := make([]pathOpKind, len(path.ops))
+	for idx, op := range path.ops {
+		kinds[idx] = op.kind
+	}
+	expected := []pathOpKind{
+		pathMoveTo, pathLineTo, pathLineTo, pathClose,
+		pathMoveTo, pathLineTo, pathCubeTo, pathCubeTo, pathCubeTo, pathCubeTo, pathLineTo, pathLineTo,
+	}
+	if len(kinds) != len(expected) {
+		t.Fatal("expected", expected, "got", kinds)
+	}
+	for idx := range expected {
+		if kinds[idx] != expected[idx] {
+			t.Fatal("expected", expected, "got", kinds)
+		}
+	}
+	if start := path.ops[0].points[0]; start != (point{10, -5.5}) {
+		t.Error("expected to start at 10,-5.5, got", start)
+	}
+	// The relative move after closing is from the start of the closed subpath.
+	if second := path.ops[4].points[0]; second != (point{11, -4.5}) {
+		t.Error("expected second subpath at 11,-4.5, got", second)
+	}
+	if end := path.current; end != (point{0, 0}) {
+		t.Error("expected to end at 0,0, got", end)
+	}
+
+	// Everything up to an error is kept.
+	if path := parseSvgPathData("M0 0L10 10L5"); len(path.ops) != 2 {
+		t.Error("expected the path up to the error, got", path.ops)
+	}
+}
+
+func TestRasterizeSvgIcons(t *testing.T) {
+	server := newTestServer(t, testSites)
+	config := Config{
+		TargetHeight:          96,
+		AllowSvg:              true,
+		RasterizeSvg:          true,
+		MaxConcurrentRequests: 4,
+		HTTPClient:            &http.Client{Transport: server.transport()},
+		Targets:               []Target{{Height: 32}},
+	}
+	sets, err := GetIconSets(context.Background(), config, []string{"svg.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	icon, err := GetIconContext(context.Background(), config, "svg.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for height, icon := range map[int]*Icon{96: icon, 32: ptr(sets["svg.test"][Target{Height: 32}])} {
+		if icon == nil || icon.Type != svgMimeType || icon.Raster == nil {
+			t.Fatal("expected an SVG with a raster, got", icon)
+		}
+		raster := icon.Raster
+		img, err := png.Decode(bytes.NewReader(raster.Source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raster.Type != "image/png" || raster.ImageConfig.Height != height || img.Bounds().Dy() != height || img.Bounds().Dx() != height {
+			t.Error("expected a", height, "pixel PNG, got", raster.Type, raster.ImageConfig, img.Bounds())
+		}
+		if c := color.NRGBAModel.Convert(img.At(height/2, height/2)).(color.NRGBA); hexColor(c) != "ff0000ff" {
+			t.Error("expected the raster to be red, got", c)
+		}
+	}
+
+	// An SVG which can't be drawn correctly is passed over for a bitmap.
+	server = newTestServer(t, map[string]testSite{
+		"evenodd.test": {
+			"/":         htmlPage(`<link rel="icon" href="/logo.svg"><link rel="icon" href="/icon.png">`),
+			"/logo.svg": {body: []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24"><path fill-rule="evenodd" d="M0 0h24v24H0z M6 6h12v12H6z" fill="red"/></svg>`)},
+			"/icon.png": pngImage(48, 48),
+		},
+	})
+	config.HTTPClient = &http.Client{Transport: server.transport()}
+	icon, err = GetIconContext(context.Background(), config, "evenodd.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if icon == nil || icon.URL != "https://evenodd.test/icon.png" {
+		t.Error("expected the PNG instead of the unsupported SVG, got", icon)
+	}
+}
+
+func ptr(icon Icon) *Icon {
+	return &icon
+}
@@ -1,50 +1,184 @@
 package iconscraper
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 )
 
 var UserAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.6.1 Safari/605.1.15"
 
+const (
+	// maxIdleConns is the maximum number of idle (keep-alive) connections kept open across all hosts.
+	maxIdleConns = 128
+	// maxIdleConnsPerHost is the maximum number of idle connections kept open to a single host. This is
+	// enough for the handful of icons typically fetched from a site after its HTML page.
+	maxIdleConnsPerHost = 4
+	// maxConnsPerHost is the maximum number of connections open to a single host at once.
+	maxConnsPerHost = 8
+	// idleConnTimeout is how long an idle connection is kept open for reuse.
+	idleConnTimeout = 30 * time.Second
+	// maxDrainBytes is the most we'll read from a discarded response body so that its connection can
+	// be reused. Larger bodies are abandoned, and the connection closed.
+	maxDrainBytes = 64 << 10
+)
+
+// Default timeouts, used when the corresponding Config field is zero.
+const (
+	defaultDialTimeout           = 10 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultResponseHeaderTimeout = 15 * time.Second
+	defaultBodyReadTimeout       = 30 * time.Second
+)
+
+// orDefault returns timeout, or def if timeout is zero.
+func orDefault(timeout, def time.Duration) time.Duration {
+	if timeout == 0 {
+		return def
+	}
+	return timeout
+}
+
+// newTransport creates the transport shared by all the workers in a pool, using the dial and TLS
+// handshake timeouts from config.
+//
+// It keeps connections alive between requests, so fetching a page and then its icons costs a single
+// TCP and TLS handshake.
+func newTransport(config Config) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   orDefault(config.DialTimeout, defaultDialTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		MaxConnsPerHost:       maxConnsPerHost,
+		IdleConnTimeout:       idleConnTimeout,
+		TLSHandshakeTimeout:   orDefault(config.TLSHandshakeTimeout, defaultTLSHandshakeTimeout),
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
 // httpJob represents a GET request, where the results should be sent down the result channel.
 type httpJob struct {
-	url    string
+	ctx  context.Context
+	url  string
+	kind resourceKind
+	// cached is the stale cached response to revalidate, or nil.
+	cached *cacheEntry
 	result chan httpResult
 }
 
-// httpResult represents the result of attempting to make a HTTP request. There will only be an error if multiple attempts where made.
+// httpResult represents the result of attempting to make a HTTP request. There will only be an error
+// if every attempt allowed by the retry policy failed.
 type httpResult struct {
 	// url sent to receive the final response, this be different if a redirect occured
 	url    *url.URL
 	status int
+	header http.Header
 	body   []byte
 	err    error
 }
 
+// flightKey identifies requests which can share a single request.
+type flightKey struct {
+	url  string
+	kind resourceKind
+}
+
+// flight is a request which is being made, whose result can be shared.
+type flight struct {
+	// done is closed once the fields below are set.
+	done chan struct{}
+	// res is the result of the request.
+	res httpResult
+	// abandoned is true if the request ended because the context of the caller making it ended.
+	abandoned bool
+}
+
 // httpWorkerPool manages a fixed size pool of workers to perform HTTP requests.
 type httpWorkerPool struct {
-	// jobs is the channel to send jobs to be completed
+	// jobs is the queue of jobs to be completed
 	//
 	// Results are returned down the channel specified in the job
-	jobs chan httpJob
+	jobs *jobQueue
+
+	// client used to make every request
+	client *http.Client
+
+	// transport is the transport owned by the pool, or nil if the client was provided in the config.
+	transport *http.Transport
+
+	// headerTimeout is the time allowed for each attempt to receive response headers.
+	headerTimeout time.Duration
+	// bodyTimeout is the time allowed for each attempt to read the response body.
+	bodyTimeout time.Duration
+
+	// limits are the maximum response sizes for each kind of resource.
+	limits sizeLimits
+
+	// retry is the policy for retrying failed requests.
+	retry *RetryPolicy
+	// clock times the delays between retries.
+	clock Clock
+
+	// politeness limits the requests made to each host, or is nil if there are no limits.
+	politeness *politeness
+
+	// robots caches robots.txt files, or is nil if they're not respected.
+	robots *robotsCache
+
+	// cache stores responses on disk, or is nil if caching is disabled.
+	cache *diskCache
+
+	// flightsMu guards flights.
+	flightsMu sync.Mutex
+	// flights are the requests currently being made.
+	flights map[flightKey]*flight
 
 	// wg for the spawned workers
 	wg sync.WaitGroup
 }
 
-func newHttpWorkerPool(workers int) *httpWorkerPool {
-	jobs := make(chan httpJob)
-	var wg sync.WaitGroup
-	wg.Add(workers)
+// newHttpWorkerPool creates a pool of config.MaxConcurrentRequests workers, making requests with
+// config.HTTPClient or, if that's nil, a client with a transport shared by all the workers.
+func newHttpWorkerPool(config Config) *httpWorkerPool {
+	workers := config.MaxConcurrentRequests
 	pool := &httpWorkerPool{
-		jobs: jobs,
-		wg:   wg,
+		jobs:          newJobQueue(),
+		flights:       make(map[flightKey]*flight),
+		client:        config.HTTPClient,
+		headerTimeout: orDefault(config.ResponseHeaderTimeout, defaultResponseHeaderTimeout),
+		bodyTimeout:   orDefault(config.BodyReadTimeout, defaultBodyReadTimeout),
+		limits:        newSizeLimits(config),
+		retry:         config.RetryPolicy,
+		clock:         config.Clock,
+	}
+	if pool.retry == nil {
+		pool.retry = &DefaultRetryPolicy
+	}
+	if pool.clock == nil {
+		pool.clock = realClock{}
+	}
+	pool.politeness = newPoliteness(config, pool.clock)
+	pool.robots = newRobotsCache(config)
+	pool.cache = newDiskCache(config, pool.clock)
+	if pool.client == nil {
+		pool.transport = newTransport(config)
+		pool.client = &http.Client{Transport: pool.transport}
 	}
+	pool.wg.Add(workers)
 	for i := 0; i < workers; i++ {
 		go pool.worker()
 	}
@@ -53,77 +187,195 @@ func newHttpWorkerPool(workers int) *httpWorkerPool {
 
 func (pool *httpWorkerPool) worker() {
 	defer pool.wg.Done()
-	for job := range pool.jobs {
-		job.result <- httpGet(job.url)
+	for {
+		job, ok := pool.jobs.pop()
+		if !ok {
+			return
+		}
+		// Skip jobs whose caller gave up while they were queued.
+		if err := job.ctx.Err(); err != nil {
+			job.result <- httpResult{err: err}
+			continue
+		}
+		if pool.politeness != nil {
+			if err := pool.politeness.wait(job.ctx, hostOf(job.url)); err != nil {
+				job.result <- httpResult{err: err}
+				continue
+			}
+		}
+		res := pool.httpGet(job.ctx, job.url, job.kind, job.cached)
+		if pool.cache != nil {
+			res = pool.cache.update(job.url, job.cached, res)
+		}
+		job.result <- res
 	}
 }
 
-// get requests a worker perform a HTTP GET request, and then waits for and returns the result.
+// get requests a worker perform a HTTP GET request for a resource of the given kind, and then waits
+// for and returns the result.
+//
+// Once allowed by the per-host concurrency limit, requests are queued and handed to workers fairly
+// across domains (see jobQueue), which then wait for the rate limits before making them. The domain is taken from ctx (see withDomain). If ctx is done
+// before the request has been made, the context error is returned.
+//
+// If robots.txt files are respected, and the URL is disallowed, a *RobotsDisallowedError is returned
+// without making a request.
 //
-// Requests are made on a first-come-first-serve basis.
-func (pool *httpWorkerPool) get(url string) httpResult {
-	httpResultChan := make(chan httpResult)
-	pool.jobs <- httpJob{
+// If there's a fresh response in the cache, it's returned without making a request. A stale one is
+// revalidated.
+//
+// Concurrent requests for the same resource (see normalizeURL) share a single request, and its
+// result, whose body must not be modified.
+func (pool *httpWorkerPool) get(ctx context.Context, url string, kind resourceKind) httpResult {
+	if !isURL(url) {
+		url = "https://" + url
+	}
+	key := flightKey{
+		url:  normalizeURL(url),
+		kind: kind,
+	}
+
+	for {
+		pool.flightsMu.Lock()
+		if f, ok := pool.flights[key]; ok {
+			pool.flightsMu.Unlock()
+			select {
+			case <-f.done:
+			case <-ctx.Done():
+				return httpResult{err: ctx.Err()}
+			}
+			// If the request was abandoned by its caller, make it ourselves.
+			if f.abandoned {
+				continue
+			}
+			return f.res
+		}
+		f := &flight{done: make(chan struct{})}
+		pool.flights[key] = f
+		pool.flightsMu.Unlock()
+
+		f.res = pool.fetch(ctx, url, kind)
+		f.abandoned = ctx.Err() != nil
+		pool.flightsMu.Lock()
+		delete(pool.flights, key)
+		pool.flightsMu.Unlock()
+		close(f.done)
+		return f.res
+	}
+}
+
+// fetch implements get, without sharing concurrent requests.
+func (pool *httpWorkerPool) fetch(ctx context.Context, url string, kind resourceKind) httpResult {
+	if pool.robots != nil && kind != resourceRobots {
+		if err := pool.robots.check(ctx, pool, url); err != nil {
+			return httpResult{err: err}
+		}
+	}
+
+	var cached *cacheEntry
+	if pool.cache != nil {
+		cached = pool.cache.load(url)
+		// Ignore responses cached with a higher size limit.
+		if cached != nil && int64(len(cached.Body)) > pool.limits[kind] {
+			cached = nil
+		}
+		if cached != nil && pool.cache.fresh(cached) {
+			return cached.result()
+		}
+	}
+
+	if pool.politeness != nil {
+		release, err := pool.politeness.acquire(ctx, hostOf(url))
+		if err != nil {
+			return httpResult{err: err}
+		}
+		defer release()
+	}
+
+	// The result channel is buffered so a worker never blocks on a caller that has given up.
+	httpResultChan := make(chan httpResult, 1)
+	pool.jobs.push(httpJob{
+		ctx:    ctx,
 		url:    url,
+		kind:   kind,
+		cached: cached,
 		result: httpResultChan,
+	})
+	select {
+	case res := <-httpResultChan:
+		return res
+	case <-ctx.Done():
+		return httpResult{err: ctx.Err()}
 	}
-	return <-httpResultChan
 }
 
-// Wait for all jobs to be completed and end all worker threads.
+// Wait for all jobs to be completed, end all worker threads and close any idle connections.
 func (pool *httpWorkerPool) close() {
-	close(pool.jobs)
+	pool.jobs.close()
 	pool.wg.Wait()
+	if pool.transport != nil {
+		pool.transport.CloseIdleConnections()
+	}
 }
 
 // httpGet sends an HTTP GET request to the specified URL and returns the result as a httpResult.
 //
 // It sets a custom User-Agent header in the request to avoid being blocked by some servers.
-func httpGet(url string) httpResult {
+//
+// The request, and any sleeps between attempts, are abandoned as soon as ctx is done. If the response
+// is larger than the limit for kind, a *ResponseTooLargeError is returned without retrying.
+//
+// If cached isn't nil, the request is made conditional on it having changed.
+func (pool *httpWorkerPool) httpGet(ctx context.Context, url string, kind resourceKind, cached *cacheEntry) httpResult {
 	if !isURL(url) {
 		url = "https://" + url
 	}
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-		},
-	}
-
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return httpResult{
-			url:    req.URL,
+			url:    nil,
 			status: 0,
 			body:   nil,
 			err:    fmt.Errorf("Failed to create request: %w", err),
 		}
 	}
 	req.Header.Set("User-Agent", UserAgent)
+	if cached != nil {
+		cached.revalidate(req)
+	}
 
 	var resp *http.Response
 	var body []byte
-	for attempt := 0; attempt < 6; attempt++ {
-		time.Sleep(500 * time.Duration(attempt) * time.Millisecond)
-		resp, err = client.Do(req)
-		if err != nil {
-			err = fmt.Errorf("Failed to send GET request: %w", err)
-			continue
+	for attempt := 1; ; attempt++ {
+		resp, body, err = pool.attempt(ctx, req, kind)
+		if err == nil {
+			break
 		}
-		if resp.StatusCode >= 500 {
-			resp.Body.Close()
-			err = fmt.Errorf("Server returned a server error status: %d %s", resp.StatusCode, resp.Status)
-			continue
+		// Retrying won't make the response any smaller.
+		if _, ok := err.(*ResponseTooLargeError); ok {
+			break
 		}
 
-		body, err = ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			err = fmt.Errorf("Failed to read response body: %w", err)
-			continue
+		// Wait before retrying, if the policy allows another attempt.
+		var retryAfter time.Duration
+		if statusErr, ok := err.(*statusError); ok {
+			retryAfter = statusErr.retryAfter
+		}
+		delay, retry := pool.retry.delay(attempt, retryAfter)
+		if !retry {
+			break
+		}
+		select {
+		case <-pool.clock.After(delay):
+		case <-ctx.Done():
+			return httpResult{
+				url:    req.URL,
+				status: 0,
+				body:   nil,
+				err:    ctx.Err(),
+			}
 		}
-
-		break
 	}
 	if err != nil {
 		return httpResult{
@@ -136,11 +388,118 @@ func httpGet(url string) httpResult {
 	return httpResult{
 		url:    resp.Request.URL,
 		status: resp.StatusCode,
+		header: resp.Header,
 		body:   body,
 		err:    nil,
 	}
 }
 
+// attempt makes a single request, reading the response body unless the server returned a status which
+// should be retried.
+//
+// The response headers must arrive within pool.headerTimeout and the body must then be read within
+// pool.bodyTimeout. The body must be no larger than the limit for kind.
+func (pool *httpWorkerPool) attempt(ctx context.Context, req *http.Request, kind resourceKind) (*http.Response, []byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	timer := time.AfterFunc(pool.headerTimeout, cancel)
+	resp, err := pool.client.Do(req.WithContext(ctx))
+	if !timer.Stop() && req.Context().Err() == nil {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, nil, fmt.Errorf("Timed out after %s waiting for response headers", pool.headerTimeout)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to send GET request: %w", err)
+	}
+	if pool.retry.retryable(resp.StatusCode) {
+		discardBody(resp)
+		return nil, nil, &statusError{
+			status:     resp.Status,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), pool.clock.Now()),
+		}
+	}
+
+	limit := pool.limits[kind]
+	tooLarge := &ResponseTooLargeError{
+		URL:      resp.Request.URL.String(),
+		Resource: kind.String(),
+		Limit:    limit,
+	}
+	// Don't bother reading a body we know is too large.
+	if resp.ContentLength > limit && !kind.truncates() {
+		resp.Body.Close()
+		return nil, nil, tooLarge
+	}
+
+	// Read at most one byte more than the limit, so we know if it's been exceeded. The limit applies
+	// to the decompressed body, so compressed responses can't sneak past it.
+	timer = time.AfterFunc(pool.bodyTimeout, cancel)
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	resp.Body.Close()
+	if !timer.Stop() && req.Context().Err() == nil {
+		return nil, nil, fmt.Errorf("Timed out after %s reading response body", pool.bodyTimeout)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read response body: %w", err)
+	}
+	if int64(len(body)) > limit {
+		if !kind.truncates() {
+			return nil, nil, tooLarge
+		}
+		body = body[:limit]
+	}
+	return resp, body, nil
+}
+
+// isWarning returns true if an error from a request should be reported as a warning, rather than an
+// error.
+func isWarning(err error) bool {
+	var tooLarge *ResponseTooLargeError
+	var disallowed *RobotsDisallowedError
+	return errors.As(err, &tooLarge) || errors.As(err, &disallowed)
+}
+
+// reportFetchError sends an error from a request to warnings if it's a warning, or errors otherwise.
+func reportFetchError(errs chan error, warnings chan error, err error) {
+	if isWarning(err) {
+		warnings <- err
+	} else {
+		errs <- err
+	}
+}
+
+// normalizeURL returns a normalised form of a URL, so equivalent URLs can be identified.
+//
+// The scheme and host are lower cased, default ports and fragments are removed and an empty path is
+// replaced by "/". If the URL can't be parsed, it's returned unchanged.
+func normalizeURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if (u.Scheme == "https" && u.Port() == "443") || (u.Scheme == "http" && u.Port() == "80") {
+		u.Host = u.Hostname()
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String()
+}
+
+// discardBody drains (up to a limit) and closes the body of a response, allowing the connection to
+// be reused.
+func discardBody(resp *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxDrainBytes))
+	resp.Body.Close()
+}
+
 // isURL checks whether the provided string `str` is a valid URL.
 //
 // It uses Go's url.Parse and checks if it returns any error to determine if the URL is valid.
@@ -0,0 +1,488 @@
+package iconscraper
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock which records, rather than waits for, the delays requested.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	delays []time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2023, 7, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) After(d time.Duration) <-chan time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.delays = append(clock.delays, d)
+	clock.now = clock.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- clock.now
+	return ch
+}
+
+// testRetryPolicy is a retry policy without jitter, so the delays are predictable.
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts:   5,
+	BaseDelay:     100 * time.Millisecond,
+	MaxDelay:      time.Second,
+	RetryStatuses: []int{http.StatusTooManyRequests, http.StatusServiceUnavailable},
+}
+
+// getWithPolicy makes a single request with a fresh pool using policy and clock.
+func getWithPolicy(client *http.Client, policy RetryPolicy, clock Clock, url string) httpResult {
+	pool := newHttpWorkerPool(Config{
+		MaxConcurrentRequests: 1,
+		HTTPClient:            client,
+		RetryPolicy:           &policy,
+		Clock:                 clock,
+	})
+	defer pool.close()
+	return pool.get(context.Background(), url, resourceHTML)
+}
+
+func TestRetryStatuses(t *testing.T) {
+	var requests int64
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt64(&requests, 1) {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "Sat, 01 Jul 2023 12:00:01 GMT")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer server.Close()
+
+	clock := newFakeClock()
+	res := getWithPolicy(server.Client(), testRetryPolicy, clock, server.URL)
+	if res.err != nil || res.status != http.StatusOK || string(res.body) != "ok" {
+		t.Fatal("unexpected result", res.status, res.err, string(res.body))
+	}
+	// The first retry uses the base delay, the second is delayed until the Retry-After date.
+	expected := []time.Duration{100 * time.Millisecond, 900 * time.Millisecond}
+	if fmt.Sprint(clock.delays) != fmt.Sprint(expected) {
+		t.Error("expected delays", expected, "got", clock.delays)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	var requests int64
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	// Statuses not in the policy are returned without retrying.
+	clock := newFakeClock()
+	res := getWithPolicy(server.Client(), testRetryPolicy, clock, server.URL+"/missing")
+	if res.err != nil || res.status != http.StatusNotFound || len(clock.delays) != 0 {
+		t.Error("expected a single 404", res.status, res.err, clock.delays)
+	}
+
+	// Retryable statuses back off exponentially, up to the max delay, then give up.
+	atomic.StoreInt64(&requests, 0)
+	clock = newFakeClock()
+	res = getWithPolicy(server.Client(), testRetryPolicy, clock, server.URL)
+	if res.err == nil {
+		t.Error("expected an error, got status", res.status)
+	}
+	if requests != 5 {
+		t.Error("expected 5 attempts, got", requests)
+	}
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond}
+	if fmt.Sprint(clock.delays) != fmt.Sprint(expected) {
+		t.Error("expected delays", expected, "got", clock.delays)
+	}
+
+	// A server asking us to wait longer than the max delay isn't retried.
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	clock = newFakeClock()
+	res = getWithPolicy(server.Client(), testRetryPolicy, clock, server.URL)
+	if res.err == nil || len(clock.delays) != 0 {
+		t.Error("expected to give up without retrying", res.err, clock.delays)
+	}
+}
+
+func TestRetryDelayJitter(t *testing.T) {
+	policy := testRetryPolicy
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay, ok := policy.delay(3, 0)
+		if !ok || delay < 200*time.Millisecond || delay > 400*time.Millisecond {
+			t.Fatal("delay out of range", delay, ok)
+		}
+	}
+	if _, ok := policy.delay(5, 0); ok {
+		t.Error("retried after the last attempt")
+	}
+}
+
+func TestRetryDelayWithoutMax(t *testing.T) {
+	// Without a max delay, the backoff grows without a cap, and Retry-After is respected.
+	policy := RetryPolicy{MaxAttempts: 10, BaseDelay: 100 * time.Millisecond}
+	for attempt, expected := range map[int]time.Duration{1: 100 * time.Millisecond, 4: 800 * time.Millisecond, 9: 25600 * time.Millisecond} {
+		if delay, ok := policy.delay(attempt, 0); !ok || delay != expected {
+			t.Error("expected attempt", attempt, "to wait", expected, "got", delay, ok)
+		}
+	}
+	if delay, ok := policy.delay(1, time.Hour); !ok || delay != time.Hour {
+		t.Error("expected to wait for Retry-After, got", delay, ok)
+	}
+	if _, ok := policy.delay(10, 0); ok {
+		t.Error("retried after the last attempt")
+	}
+}
+
+func TestDefaultRetryStatuses(t *testing.T) {
+	for _, status := range []int{408, 425, 429, 500, 501, 503, 505, 511, 520} {
+		if !DefaultRetryPolicy.retryable(status) {
+			t.Error("expected status", status, "to be retried")
+		}
+	}
+	for _, status := range []int{200, 301, 400, 403, 404} {
+		if DefaultRetryPolicy.retryable(status) {
+			t.Error("expected status", status, "not to be retried")
+		}
+	}
+}
+
+// benchmarkSites creates n sites, each linking several icons.
+func benchmarkSites(n int) (map[string]testSite, []string) {
+	sites := make(map[string]testSite, n)
+	domains := make([]string, 0, n)
+	for idx := 0; idx < n; idx++ {
+		domain := fmt.Sprintf("site%d.test", idx)
+		site := testSite{"/favicon.ico": pngImage(16, 16)}
+		var head strings.Builder
+		for _, size := range []int{32, 64, 128, 180, 256} {
+			path := fmt.Sprintf("/icon-%d.png", size)
+			fmt.Fprintf(&head, `<link rel="icon" href="%s">`, path)
+			site[path] = pngImage(size, size)
+		}
+		site["/"] = htmlPage(head.String())
+		sites[domain] = site
+		domains = append(domains, domain)
+	}
+	return sites, domains
+}
+
+// BenchmarkGetIcons compares scraping with the pool's keep-alive transport against making every
+// request on a new connection.
+func BenchmarkGetIcons(b *testing.B) {
+	sites, domains := benchmarkSites(50)
+	server := newTestServer(b, sites)
+
+	run := func(b *testing.B, client *http.Client) {
+		config := Config{
+			TargetHeight:          128,
+			MaxConcurrentRequests: 16,
+			HTTPClient:            client,
+			Errors:                make(chan error, 1024),
+			Warnings:              make(chan error, 1024),
+		}
+		atomic.StoreInt64(&server.conns, 0)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if icons := GetIcons(config, domains); len(icons) != len(domains) {
+				b.Fatal("expected", len(domains), "icons, got", len(icons))
+			}
+		}
+		b.StopTimer()
+		b.ReportMetric(float64(atomic.LoadInt64(&server.conns))/float64(b.N), "handshakes/op")
+	}
+
+	b.Run("shared-transport", func(b *testing.B) {
+		transport := server.transport()
+		defer transport.CloseIdleConnections()
+		run(b, &http.Client{Transport: transport})
+	})
+	b.Run("no-keep-alive", func(b *testing.B) {
+		transport := server.transport()
+		transport.DisableKeepAlives = true
+		run(b, &http.Client{Transport: transport})
+	})
+}
+
+func TestPerHostConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	active := make(map[string]int)
+	maxActive := make(map[string]int)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active[r.Host]++
+		if active[r.Host] > maxActive[r.Host] {
+			maxActive[r.Host] = active[r.Host]
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		active[r.Host]--
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	pool := newHttpWorkerPool(Config{
+		MaxConcurrentRequests:        8,
+		MaxConcurrentRequestsPerHost: 2,
+		HTTPClient:                   server.Client(),
+	})
+	defer pool.close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res := pool.get(context.Background(), server.URL, resourceImage); res.err != nil {
+				t.Error(res.err)
+			}
+		}()
+	}
+	wg.Wait()
+	for host, max := range maxActive {
+		if max > 2 {
+			t.Error("expected at most 2 concurrent requests to", host, "got", max)
+		}
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	clock := newFakeClock()
+	pool := newHttpWorkerPool(Config{
+		MaxConcurrentRequests:    1,
+		RequestsPerSecondPerHost: 10,
+		RequestsPerSecond:        5,
+		HTTPClient:               server.Client(),
+		Clock:                    clock,
+	})
+	defer pool.close()
+
+	// The global limit is the stricter, so it spaces out requests to the same host.
+	for i := 0; i < 3; i++ {
+		pool.get(context.Background(), server.URL, resourceImage)
+	}
+	expected := []time.Duration{200 * time.Millisecond, 200 * time.Millisecond}
+	if fmt.Sprint(clock.delays) != fmt.Sprint(expected) {
+		t.Error("expected delays", expected, "got", clock.delays)
+	}
+}
+
+func TestRateLimitsAfterQueueing(t *testing.T) {
+	clock := newFakeClock()
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	var mu sync.Mutex
+	var starts []time.Time
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			close(started)
+			<-unblock
+			clock.After(time.Second)
+			return
+		}
+		mu.Lock()
+		starts = append(starts, clock.Now())
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	pool := newHttpWorkerPool(Config{
+		MaxConcurrentRequests:    1,
+		RequestsPerSecondPerHost: 10,
+		HTTPClient:               server.Client(),
+		Clock:                    clock,
+	})
+	defer pool.close()
+
+	// Requests queued behind a slow one are still spaced out when they're made.
+	var wg sync.WaitGroup
+	get := func(path string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.get(context.Background(), server.URL+path, resourceImage)
+		}()
+	}
+	get("/block")
+	<-started
+	get("/a")
+	get("/b")
+	time.Sleep(50 * time.Millisecond)
+	close(unblock)
+	wg.Wait()
+	if len(starts) != 2 || starts[1].Sub(starts[0]) < 100*time.Millisecond {
+		t.Error("expected requests to start 100ms apart, got", starts)
+	}
+}
+
+func TestJobQueueFairness(t *testing.T) {
+	queue := newJobQueue()
+	push := func(domain, url string, kind resourceKind) {
+		queue.push(httpJob{
+			ctx:  withDomain(context.Background(), domain),
+			url:  url,
+			kind: kind,
+		})
+	}
+	for i := 0; i < 4; i++ {
+		push("many.test", fmt.Sprint("many-", i), resourceImage)
+	}
+	push("one.test", "one-0", resourceImage)
+	push("page.test", "page", resourceHTML)
+	push("one.test", "one-1", resourceImage)
+	push("many.test", "manifest", resourceManifest)
+	queue.close()
+
+	var order []string
+	for {
+		job, ok := queue.pop()
+		if !ok {
+			break
+		}
+		order = append(order, job.url)
+	}
+	expected := []string{"page", "manifest", "many-0", "one-0", "many-1", "one-1", "many-2", "many-3"}
+	if fmt.Sprint(order) != fmt.Sprint(expected) {
+		t.Error("expected order", expected, "got", order)
+	}
+}
+
+// withHeader returns res with a header added.
+func withHeader(res testResponse, key, value string) testResponse {
+	res.header = http.Header{}
+	res.header.Set(key, value)
+	return res
+}
+
+func TestDiskCache(t *testing.T) {
+	sites := map[string]testSite{
+		"cached.test": {
+			"/":            withHeader(htmlPage(`<link rel="icon" href="/fresh.png"><link rel="icon" href="/etag.png">`), "Cache-Control", "max-age=3600"),
+			"/favicon.ico": withHeader(pngImage(16, 16), "Cache-Control", "no-store"),
+			"/fresh.png":   withHeader(pngImage(32, 32), "Cache-Control", "max-age=60"),
+			"/etag.png":    withHeader(pngImage(64, 64), "ETag", `"v1"`),
+		},
+	}
+	server := newTestServer(t, sites)
+	clock := newFakeClock()
+	config := Config{
+		TargetHeight:          64,
+		MaxConcurrentRequests: 4,
+		HTTPClient:            &http.Client{Transport: server.transport()},
+		CacheDir:              t.TempDir(),
+		Clock:                 clock,
+	}
+
+	scrape := func() {
+		t.Helper()
+		atomic.StoreInt64(&server.requests, 0)
+		atomic.StoreInt64(&server.notModified, 0)
+		if icon := GetIcon(config, "cached.test"); icon == nil || icon.ImageConfig.Height != 64 {
+			t.Fatal("expected the 64px icon, got", icon)
+		}
+	}
+
+	// Everything is fetched the first time.
+	scrape()
+	if server.requests != 4 {
+		t.Error("expected 4 requests, got", server.requests)
+	}
+
+	// The page and fresh image are served from the cache, the no-store favicon is fetched again, and
+	// the image with only an ETag is revalidated.
+	scrape()
+	if server.requests != 2 || server.notModified != 1 {
+		t.Error("expected 2 requests, 1 not modified, got", server.requests, server.notModified)
+	}
+
+	// After the fresh image expires, it's fetched again too.
+	clock.After(2 * time.Minute)
+	scrape()
+	if server.requests != 3 || server.notModified != 1 {
+		t.Error("expected 3 requests, 1 not modified, got", server.requests, server.notModified)
+	}
+}
+
+func TestSharedRequests(t *testing.T) {
+	var requests int64
+	release := make(chan struct{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		<-release
+		w.Write([]byte("icon"))
+	}))
+	defer server.Close()
+
+	pool := newHttpWorkerPool(Config{
+		MaxConcurrentRequests: 8,
+		HTTPClient:            server.Client(),
+	})
+	defer pool.close()
+
+	// Equivalent URLs share a single request.
+	urls := []string{server.URL + "/icon.png", server.URL + "/icon.png#frag", strings.ToUpper(server.URL[:8]) + server.URL[8:] + "/icon.png"}
+	results := make(chan httpResult)
+	for i := 0; i < 9; i++ {
+		go func(url string) {
+			results <- pool.get(context.Background(), url, resourceImage)
+		}(urls[i%len(urls)])
+	}
+	// Wait for the requests to arrive before releasing them.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < 9; i++ {
+		if res := <-results; res.err != nil || string(res.body) != "icon" {
+			t.Error("unexpected result", res.err, string(res.body))
+		}
+	}
+	if requests != 1 {
+		t.Error("expected 1 request, got", requests)
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	tests := map[string]string{
+		"https://Example.COM":               "https://example.com/",
+		"HTTPS://example.com:443/a/b.png#x": "https://example.com/a/b.png",
+		"http://example.com:80/?q=1":        "http://example.com/?q=1",
+		"https://example.com:8443/Icon.png": "https://example.com:8443/Icon.png",
+	}
+	for input, expected := range tests {
+		if normalized := normalizeURL(input); normalized != expected {
+			t.Error(input, "expected", expected, "got", normalized)
+		}
+	}
+}
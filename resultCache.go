@@ -0,0 +1,114 @@
+package iconscraper
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default result cache lifetimes, used when the corresponding Config field is zero.
+const (
+	defaultResultCacheTTL         = time.Hour
+	defaultNegativeResultCacheTTL = 5 * time.Minute
+)
+
+// resultCache is a least-recently-used cache of the icons selected for each domain.
+//
+// It is safe for concurrent use.
+type resultCache struct {
+	// size is the maximum number of domains cached.
+	size int
+	// ttl is how long an icon is cached for.
+	ttl time.Duration
+	// negativeTTL is how long a domain without an icon is cached for.
+	negativeTTL time.Duration
+	// clock used to expire entries.
+	clock Clock
+
+	mu sync.Mutex
+	// entries are the *resultCacheEntry values, most recently used first.
+	entries *list.List
+	// elements indexes entries by domain.
+	elements map[string]*list.Element
+}
+
+// resultCacheEntry is a cached result for a domain.
+type resultCacheEntry struct {
+	domain string
+	// result holds the selected icons.
+	result Result
+	// expires is when the entry should no longer be used.
+	expires time.Time
+}
+
+// newResultCache creates a cache from the config, or returns nil if result caching is disabled.
+func newResultCache(config Config, clock Clock) *resultCache {
+	if config.ResultCacheSize <= 0 {
+		return nil
+	}
+	return &resultCache{
+		size:        config.ResultCacheSize,
+		ttl:         orDefault(config.ResultCacheTTL, defaultResultCacheTTL),
+		negativeTTL: orDefault(config.NegativeResultCacheTTL, defaultNegativeResultCacheTTL),
+		clock:       clock,
+		entries:     list.New(),
+		elements:    make(map[string]*list.Element),
+	}
+}
+
+// cacheKey normalises a domain for use as a key.
+func cacheKey(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// get returns the cached result for domain. If the domain isn't cached, or has expired, false is
+// returned.
+func (cache *resultCache) get(domain string) (Result, bool) {
+	key := cacheKey(domain)
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	element, ok := cache.elements[key]
+	if !ok {
+		return Result{}, false
+	}
+	entry := element.Value.(*resultCacheEntry)
+	if !cache.clock.Now().Before(entry.expires) {
+		cache.entries.Remove(element)
+		delete(cache.elements, key)
+		return Result{}, false
+	}
+	cache.entries.MoveToFront(element)
+	return entry.result, true
+}
+
+// put caches the result for domain, which may not have any icons, evicting the least recently used
+// domain if the cache is full.
+func (cache *resultCache) put(domain string, result Result) {
+	key := cacheKey(domain)
+	ttl := cache.ttl
+	if result.Icon == nil && len(result.Set) == 0 {
+		ttl = cache.negativeTTL
+	}
+	entry := &resultCacheEntry{
+		domain:  key,
+		result:  result,
+		expires: cache.clock.Now().Add(ttl),
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if element, ok := cache.elements[key]; ok {
+		element.Value = entry
+		cache.entries.MoveToFront(element)
+		return
+	}
+	cache.elements[key] = cache.entries.PushFront(entry)
+	for cache.entries.Len() > cache.size {
+		oldest := cache.entries.Back()
+		cache.entries.Remove(oldest)
+		delete(cache.elements, oldest.Value.(*resultCacheEntry).domain)
+	}
+}
@@ -0,0 +1,153 @@
+package iconscraper
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clock tells the time and waits. A fake clock can be set in the config so that retries can be
+// tested without real sleeps.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After waits for the duration to elapse and then sends the current time on the returned
+	// channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock used by default, using the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// RetryPolicy determines how failed requests are retried.
+//
+// Requests which fail to get a response, and those which receive one of RetryStatuses (or any 5xx
+// status, if RetryServerErrors is set), are retried with exponential backoff. If the server sends a Retry-After header, the retry is delayed until
+// at least then.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts made for each request, including the first.
+	MaxAttempts int
+
+	// BaseDelay is the delay before the first retry. Each following retry waits twice as long as the
+	// one before.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the delay before each retry. If a server asks us to wait longer than this using
+	// Retry-After, the request isn't retried. If zero, there is no cap.
+	MaxDelay time.Duration
+
+	// Jitter is the fraction, between 0 and 1, of each backoff delay which is randomised. With a
+	// jitter of 0.5, each delay is between half and all of the exponential backoff delay.
+	Jitter float64
+
+	// RetryStatuses are the HTTP status codes which are retried.
+	RetryStatuses []int
+
+	// RetryServerErrors retries every 5xx status, as well as RetryStatuses.
+	RetryServerErrors bool
+}
+
+// DefaultRetryPolicy is the policy used when Config.RetryPolicy is nil.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 6,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+	Jitter:      0.5,
+	RetryStatuses: []int{
+		http.StatusRequestTimeout,
+		http.StatusTooEarly,
+		http.StatusTooManyRequests,
+	},
+	RetryServerErrors: true,
+}
+
+// retryable returns true if a response with the status should be retried.
+func (policy *RetryPolicy) retryable(status int) bool {
+	if policy.RetryServerErrors && status >= 500 && status < 600 {
+		return true
+	}
+	for _, retryStatus := range policy.RetryStatuses {
+		if status == retryStatus {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns how long to wait before the retry following attempt (counting from 1).
+//
+// retryAfter is the delay requested by the server, or zero if it didn't request one. If the
+// request shouldn't be retried, false is returned.
+func (policy *RetryPolicy) delay(attempt int, retryAfter time.Duration) (time.Duration, bool) {
+	if attempt >= policy.MaxAttempts {
+		return 0, false
+	}
+	// Without a cap, the delay is still limited so that it doesn't overflow.
+	maxDelay := policy.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = math.MaxInt64 / 2
+	}
+	if retryAfter > maxDelay {
+		return 0, false
+	}
+
+	delay := policy.BaseDelay
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	delay -= time.Duration(policy.Jitter * rand.Float64() * float64(delay))
+
+	if delay < retryAfter {
+		delay = retryAfter
+	}
+	return delay, true
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a number of seconds or
+// a HTTP date, returning how long to wait from now. Zero is returned if the header is missing or
+// invalid.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// statusError is the error for an attempt which received a retryable status.
+type statusError struct {
+	// status is the status line, such as "503 Service Unavailable".
+	status string
+
+	// retryAfter is the delay requested by the server with the Retry-After header, or zero.
+	retryAfter time.Duration
+}
+
+func (err *statusError) Error() string {
+	return fmt.Sprintf("Server returned status %s", err.status)
+}
@@ -0,0 +1,293 @@
+package iconscraper
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRobotsUserAgent is the product token used to find our rules in robots.txt files, if
+// Config.RobotsUserAgent isn't set.
+const defaultRobotsUserAgent = "iconscraper"
+
+// robotsMaxAge is how long a robots.txt file is cached for, as recommended by RFC 9309.
+const robotsMaxAge = 24 * time.Hour
+
+// RobotsDisallowedError is the warning reported when a resource isn't fetched because the host's
+// robots.txt disallows it.
+//
+// If a host's robots.txt can't be fetched because of a network or server error, every URL on that
+// host is disallowed.
+type RobotsDisallowedError struct {
+	// URL of the resource that was skipped.
+	URL string
+}
+
+func (err *RobotsDisallowedError) Error() string {
+	return fmt.Sprintf("%s is disallowed by robots.txt", err.URL)
+}
+
+// robotsRule is an allow or disallow rule from a robots.txt file.
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+// robotsRules are the rules from a robots.txt file which apply to us.
+type robotsRules struct {
+	rules []robotsRule
+}
+
+// allowAll is the rules for a host without a robots.txt file.
+var allowAll = &robotsRules{}
+
+// disallowAll is the rules for a host whose robots.txt is unreachable.
+var disallowAll = &robotsRules{rules: []robotsRule{{allow: false, pattern: "/"}}}
+
+// parseRobots parses a robots.txt file (https://www.rfc-editor.org/rfc/rfc9309), returning the rules
+// for the groups matching userAgent or, if none do, the groups for "*".
+func parseRobots(body []byte, userAgent string) *robotsRules {
+	userAgent = strings.ToLower(userAgent)
+
+	var ours, star []robotsRule
+	var matchesUs, matchesStar, foundUs bool
+	// inRules is true once a group's rules have started, so the next user-agent starts a new group.
+	inRules := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			if inRules {
+				matchesUs, matchesStar, inRules = false, false, false
+			}
+			// Compare only the product token, ignoring any version.
+			token, _, _ := strings.Cut(strings.ToLower(value), "/")
+			if token == userAgent {
+				matchesUs, foundUs = true, true
+			} else if token == "*" {
+				matchesStar = true
+			}
+		case "allow", "disallow":
+			inRules = true
+			// An empty disallow rule allows everything, so is the same as no rule.
+			if value == "" {
+				continue
+			}
+			rule := robotsRule{allow: key == "allow", pattern: value}
+			if matchesUs {
+				ours = append(ours, rule)
+			}
+			if matchesStar {
+				star = append(star, rule)
+			}
+		}
+	}
+	if foundUs {
+		return &robotsRules{rules: ours}
+	}
+	return &robotsRules{rules: star}
+}
+
+// allowed returns true if the rules allow fetching path, which should include the query string.
+//
+// The longest matching rule applies, with allow rules winning ties. Paths matching no rules are
+// allowed.
+func (rules *robotsRules) allowed(path string) bool {
+	allowed := true
+	longest := -1
+	for _, rule := range rules.rules {
+		if len(rule.pattern) < longest || !matchRobotsPattern(rule.pattern, path) {
+			continue
+		}
+		if len(rule.pattern) > longest || rule.allow {
+			allowed = rule.allow
+		}
+		longest = len(rule.pattern)
+	}
+	return allowed
+}
+
+// matchRobotsPattern returns true if path matches a robots.txt path pattern, in which "*" matches any
+// sequence of characters and a trailing "$" matches the end of the path.
+func matchRobotsPattern(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+
+	parts := strings.Split(pattern, "*")
+	// The first part must match the start of the path.
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	path = path[len(parts[0]):]
+	// Each following part must appear after the last.
+	for idx, part := range parts[1:] {
+		last := idx == len(parts)-2
+		if last && anchored {
+			return strings.HasSuffix(path, part)
+		}
+		pos := strings.Index(path, part)
+		if pos < 0 {
+			return false
+		}
+		path = path[pos+len(part):]
+	}
+	return !anchored || path == ""
+}
+
+// robotsCache fetches and caches the robots.txt rules for each host.
+//
+// It is safe for concurrent use.
+type robotsCache struct {
+	// userAgent is the product token to find rules for.
+	userAgent string
+
+	mu sync.Mutex
+	// entries for each origin ("https://example.com").
+	entries map[string]*robotsEntry
+}
+
+// robotsEntry is a cached robots.txt file, which might still be being fetched.
+type robotsEntry struct {
+	// done is closed once the fields below are set.
+	done chan struct{}
+	// rules from the file.
+	rules *robotsRules
+	// err is the error fetching the file, if the host couldn't be reached. Everything is disallowed,
+	// but it's reported as this error, rather than as the site's policy.
+	err error
+	// fetched is when the file was fetched.
+	fetched time.Time
+	// abandoned is true if the fetch was abandoned because its context ended, in which case the
+	// entry has been removed and should be fetched again.
+	abandoned bool
+}
+
+// newRobotsCache creates a cache from the config, or returns nil if robots.txt isn't respected.
+func newRobotsCache(config Config) *robotsCache {
+	if !config.RespectRobotsTxt {
+		return nil
+	}
+	userAgent := config.RobotsUserAgent
+	if userAgent == "" {
+		userAgent = defaultRobotsUserAgent
+	}
+	return &robotsCache{
+		userAgent: userAgent,
+		entries:   make(map[string]*robotsEntry),
+	}
+}
+
+// check returns a *RobotsDisallowedError if the robots.txt for the URL's host disallows it, fetching
+// the robots.txt with the pool if it's not cached. If the robots.txt couldn't be fetched because the
+// host is unreachable, the error fetching it is returned instead.
+func (cache *robotsCache) check(ctx context.Context, pool *httpWorkerPool, rawURL string) error {
+	if !isURL(rawURL) {
+		rawURL = "https://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// The request will fail anyway.
+		return nil
+	}
+	rules, err := cache.rules(ctx, pool, u.Scheme+"://"+u.Host)
+	if err != nil {
+		return err
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	if !rules.allowed(path) {
+		return &RobotsDisallowedError{URL: rawURL}
+	}
+	return nil
+}
+
+// rules returns the rules for an origin, fetching them if they aren't cached or have expired. If the
+// host is unreachable, the error fetching them is returned.
+//
+// Concurrent callers for the same origin share a single fetch.
+func (cache *robotsCache) rules(ctx context.Context, pool *httpWorkerPool, origin string) (*robotsRules, error) {
+	for {
+		cache.mu.Lock()
+		entry := cache.entries[origin]
+		if entry != nil {
+			select {
+			case <-entry.done:
+				if pool.clock.Now().Sub(entry.fetched) > robotsMaxAge {
+					entry = nil
+				}
+			default:
+			}
+		}
+		if entry == nil {
+			entry = &robotsEntry{done: make(chan struct{})}
+			cache.entries[origin] = entry
+			cache.mu.Unlock()
+			cache.fetch(ctx, pool, origin, entry)
+		} else {
+			cache.mu.Unlock()
+		}
+
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if !entry.abandoned {
+			return entry.rules, entry.err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// fetch gets and parses the robots.txt for origin, completing entry.
+func (cache *robotsCache) fetch(ctx context.Context, pool *httpWorkerPool, origin string, entry *robotsEntry) {
+	defer close(entry.done)
+
+	res := pool.get(ctx, origin+"/robots.txt", resourceRobots)
+	entry.fetched = pool.clock.Now()
+	switch {
+	case res.err != nil && ctx.Err() != nil:
+		// Leave it for the next caller to try again.
+		entry.abandoned = true
+		cache.mu.Lock()
+		if cache.entries[origin] == entry {
+			delete(cache.entries, origin)
+		}
+		cache.mu.Unlock()
+	case res.err != nil:
+		// The host is unreachable, so assume it disallows everything, but report why.
+		entry.rules = disallowAll
+		entry.err = fmt.Errorf("Failed to get %s/robots.txt: %w", origin, res.err)
+	case res.status >= 200 && res.status < 300:
+		entry.rules = parseRobots(res.body, cache.userAgent)
+	case res.status >= 400 && res.status < 500:
+		// Robots.txt is unavailable, so there are no restrictions.
+		entry.rules = allowAll
+	default:
+		entry.rules = disallowAll
+	}
+}
@@ -0,0 +1,156 @@
+package iconscraper
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseRobots(t *testing.T) {
+	robots := []byte(`
+# Comments are ignored
+User-agent: *
+Disallow: /private/
+Allow: /private/icons/
+
+User-agent: SomeBot
+User-agent: IconScraper/2.0
+Disallow: /*.png$
+Allow: /ok.png
+Disallow: /search?
+
+User-agent: other
+Disallow: /
+`)
+	tests := []struct {
+		userAgent string
+		path      string
+		allowed   bool
+	}{
+		{"anybot", "/", true},
+		{"anybot", "/private/thing", false},
+		{"anybot", "/private/icons/icon.png", true},
+		{"iconscraper", "/private/thing", true},
+		{"iconscraper", "/icon.png", false},
+		{"iconscraper", "/icon.png?v=2", true},
+		{"iconscraper", "/ok.png", true},
+		{"iconscraper", "/search?q=icons", false},
+		{"iconscraper", "/search", true},
+		{"somebot", "/a/b/c.png", false},
+		{"other", "/favicon.ico", false},
+	}
+	for _, test := range tests {
+		rules := parseRobots(robots, test.userAgent)
+		if allowed := rules.allowed(test.path); allowed != test.allowed {
+			t.Error(test.userAgent, test.path, "expected allowed", test.allowed, "got", allowed)
+		}
+	}
+}
+
+func TestMatchRobotsPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"/", "/anything", true},
+		{"/fish", "/fish.html", true},
+		{"/fish", "/Fish", false},
+		{"/fish*", "/fishheads", true},
+		{"/*.php", "/folder/filename.php?params", true},
+		{"/*.php$", "/filename.php", true},
+		{"/*.php$", "/filename.php?params", false},
+		{"/fish*.php", "/fishheads/catfish.php", true},
+		{"/fish*.php", "/Fish.PHP", false},
+		{"/$", "/", true},
+		{"/$", "/page", false},
+	}
+	for _, test := range tests {
+		if match := matchRobotsPattern(test.pattern, test.path); match != test.match {
+			t.Error(test.pattern, test.path, "expected", test.match, "got", match)
+		}
+	}
+}
+
+func TestRespectRobotsTxt(t *testing.T) {
+	sites := map[string]testSite{
+		"polite.test": {
+			"/robots.txt":       {body: []byte("User-agent: *\nDisallow: /private/\n")},
+			"/":                 htmlPage(`<link rel="icon" href="/private/icon.png"><link rel="icon" href="/public.png">`),
+			"/private/icon.png": pngImage(128, 128),
+			"/public.png":       pngImage(32, 32),
+		},
+		"closed.test": {
+			"/robots.txt": {body: []byte("User-agent: iconscraper\nDisallow: /\n")},
+			"/":           htmlPage(`<link rel="icon" href="/icon.png">`),
+			"/icon.png":   pngImage(32, 32),
+		},
+	}
+	config := Config{
+		TargetHeight:          128,
+		MaxConcurrentRequests: 4,
+		HTTPClient:            newTestClient(t, sites),
+		RespectRobotsTxt:      true,
+		Errors:                make(chan error, 16),
+		Warnings:              make(chan error, 16),
+	}
+	icons := GetIcons(config, []string{"polite.test", "closed.test"})
+	if icon, ok := icons["polite.test"]; !ok || icon.URL != "https://polite.test/public.png" {
+		t.Error("expected the public icon, got", icon.URL)
+	}
+	if icon, ok := icons["closed.test"]; ok {
+		t.Error("found icon for closed.test", icon.URL)
+	}
+
+	close(config.Warnings)
+	disallowed := make(map[string]bool)
+	for warning := range config.Warnings {
+		var err *RobotsDisallowedError
+		if errors.As(warning, &err) {
+			disallowed[err.URL] = true
+		}
+	}
+	for _, url := range []string{"https://polite.test/private/icon.png", "https://closed.test"} {
+		if !disallowed[url] {
+			t.Error("expected", url, "to be disallowed, got", disallowed)
+		}
+	}
+}
+
+func TestRobotsTxtUnreachable(t *testing.T) {
+	transport := newTransport(Config{})
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("network is down")
+	}
+	config := Config{
+		MaxConcurrentRequests: 4,
+		HTTPClient:            &http.Client{Transport: transport},
+		RetryPolicy:           &RetryPolicy{MaxAttempts: 1},
+		RespectRobotsTxt:      true,
+		Errors:                make(chan error, 16),
+		Warnings:              make(chan error, 16),
+	}
+	if icon := GetIcon(config, "offline.test"); icon != nil {
+		t.Error("expected no icon, got", icon)
+	}
+
+	// The network error is reported, rather than the site's robots.txt disallowing everything.
+	close(config.Warnings)
+	for warning := range config.Warnings {
+		var disallowed *RobotsDisallowedError
+		if errors.As(warning, &disallowed) {
+			t.Error("expected no robots.txt warnings, got", warning)
+		}
+	}
+	close(config.Errors)
+	var errs []error
+	for err := range config.Errors {
+		errs = append(errs, err)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "network is down") {
+		t.Error("expected the network error, got", errs)
+	}
+}
@@ -0,0 +1,273 @@
+package iconscraper
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SvgSanitizedError is the warning reported when elements or attributes are removed from an SVG by
+// Config.SanitizeSvg. The sanitized icon is still used.
+type SvgSanitizedError struct {
+	// URL of the SVG.
+	URL string
+
+	// Removed describes what was removed: elements as "<name>", and attributes by name.
+	Removed []string
+}
+
+func (err *SvgSanitizedError) Error() string {
+	return fmt.Sprintf("removed %s from SVG %s", strings.Join(err.Removed, ", "), err.URL)
+}
+
+// svgAllowedElements are the elements kept by sanitizeSvg. Others are removed along with their
+// content.
+var svgAllowedElements = map[string]bool{
+	"svg": true, "g": true, "defs": true, "title": true, "desc": true, "symbol": true, "use": true,
+	"path": true, "rect": true, "circle": true, "ellipse": true, "line": true, "polyline": true,
+	"polygon": true, "text": true, "tspan": true, "textPath": true, "image": true, "switch": true,
+	"linearGradient": true, "radialGradient": true, "stop": true, "pattern": true, "marker": true,
+	"clipPath": true, "mask": true, "style": true,
+	"filter": true, "feBlend": true, "feColorMatrix": true, "feComponentTransfer": true,
+	"feComposite": true, "feDropShadow": true, "feFlood": true, "feFuncA": true, "feFuncB": true,
+	"feFuncG": true, "feFuncR": true, "feGaussianBlur": true, "feMerge": true, "feMergeNode": true,
+	"feMorphology": true, "feOffset": true,
+}
+
+// svgAllowedAttributes are the attributes, without a namespace, kept by sanitizeSvg. Attributes
+// starting with "aria-" or "data-" are also kept.
+var svgAllowedAttributes = map[string]bool{
+	// Core and structural attributes.
+	"id": true, "class": true, "style": true, "lang": true, "role": true, "tabindex": true,
+	"version": true, "baseProfile": true, "width": true, "height": true, "viewBox": true,
+	"preserveAspectRatio": true, "x": true, "y": true, "transform": true, "href": true,
+	"xmlns": true, "title": true,
+	// Shapes.
+	"d": true, "pathLength": true, "points": true, "cx": true, "cy": true, "r": true, "rx": true,
+	"ry": true, "x1": true, "y1": true, "x2": true, "y2": true,
+	// Presentation attributes.
+	"fill": true, "fill-opacity": true, "fill-rule": true, "stroke": true, "stroke-width": true,
+	"stroke-opacity": true, "stroke-linecap": true, "stroke-linejoin": true,
+	"stroke-miterlimit": true, "stroke-dasharray": true, "stroke-dashoffset": true,
+	"opacity": true, "color": true, "display": true, "visibility": true, "overflow": true,
+	"clip-path": true, "clip-rule": true, "mask": true, "filter": true, "stop-color": true,
+	"stop-opacity": true, "marker-start": true, "marker-mid": true, "marker-end": true,
+	"vector-effect": true, "shape-rendering": true, "color-interpolation-filters": true,
+	"mix-blend-mode": true, "paint-order": true, "flood-color": true, "flood-opacity": true,
+	"font-family": true, "font-size": true, "font-style": true, "font-weight": true,
+	"letter-spacing": true, "text-anchor": true, "dominant-baseline": true, "dx": true, "dy": true,
+	"rotate": true, "textLength": true, "lengthAdjust": true, "startOffset": true,
+	// Gradients, patterns, markers, clipping and masks.
+	"offset": true, "gradientUnits": true, "gradientTransform": true, "spreadMethod": true,
+	"fx": true, "fy": true, "fr": true, "patternUnits": true, "patternContentUnits": true,
+	"patternTransform": true, "markerWidth": true, "markerHeight": true, "markerUnits": true,
+	"orient": true, "refX": true, "refY": true, "clipPathUnits": true, "maskUnits": true,
+	"maskContentUnits": true,
+	// Filters.
+	"filterUnits": true, "primitiveUnits": true, "in": true, "in2": true, "result": true,
+	"mode": true, "type": true, "values": true, "operator": true, "k1": true, "k2": true,
+	"k3": true, "k4": true, "stdDeviation": true, "edgeMode": true, "radius": true,
+	"tableValues": true, "slope": true, "intercept": true, "amplitude": true, "exponent": true,
+}
+
+// svgAllowedPrefixedAttributes are the attributes with a namespace prefix kept by sanitizeSvg, other
+// than namespace declarations. Elements must not have a prefix, or be in the svg namespace.
+var svgAllowedPrefixedAttributes = map[xml.Name]bool{
+	{Space: "xlink", Local: "href"}:  true,
+	{Space: "xlink", Local: "title"}: true,
+	{Space: "xml", Local: "space"}:   true,
+	{Space: "xml", Local: "lang"}:    true,
+}
+
+// svgAllowedNamespaceURIs are the namespaces which may be declared, by prefix, in an SVG kept by
+// sanitizeSvg.
+var svgAllowedNamespaceURIs = map[string]string{
+	"xlink": "http://www.w3.org/1999/xlink",
+	"svg":   svgNamespace,
+}
+
+// sanitizeSvg removes everything from an SVG image that could run scripts or load external
+// resources when it's displayed, returning the sanitized image and a description of what was
+// removed.
+//
+// Only allow-listed elements and attributes are kept. Links (href) must be to fragments within the
+// image, or to data URLs for images. Attributes and stylesheets referencing other resources with
+// url() are removed, as are those containing backslashes, since CSS escapes could hide a reference.
+// Comments, processing instructions (except the XML declaration) and doctypes are also removed.
+func sanitizeSvg(data []byte) ([]byte, []string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+
+	var out bytes.Buffer
+	var removed []string
+	seen := make(map[string]bool)
+	remove := func(what string) {
+		if !seen[what] {
+			seen[what] = true
+			removed = append(removed, what)
+		}
+	}
+
+	// skipDepth is the depth within a removed element.
+	skipDepth := 0
+	// inStyle is true within a style element, whose text is checked separately.
+	inStyle := false
+	var style bytes.Buffer
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			if skipDepth > 0 {
+				skipDepth++
+				continue
+			}
+			if !svgElementAllowed(token.Name) {
+				remove("<" + qualifiedName(token.Name) + ">")
+				skipDepth = 1
+				continue
+			}
+			out.WriteByte('<')
+			out.WriteString(qualifiedName(token.Name))
+			for _, attr := range token.Attr {
+				if !svgAttributeAllowed(token.Name.Local, attr) {
+					remove(qualifiedName(attr.Name))
+					continue
+				}
+				out.WriteByte(' ')
+				out.WriteString(qualifiedName(attr.Name))
+				out.WriteString(`="`)
+				xml.EscapeText(&out, []byte(attr.Value))
+				out.WriteByte('"')
+			}
+			out.WriteByte('>')
+			if token.Name.Local == "style" {
+				inStyle = true
+				style.Reset()
+			}
+		case xml.EndElement:
+			if skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+			if inStyle {
+				inStyle = false
+				if cssSafe(style.String()) {
+					xml.EscapeText(&out, style.Bytes())
+				} else {
+					remove("stylesheet")
+				}
+			}
+			out.WriteString("</")
+			out.WriteString(qualifiedName(token.Name))
+			out.WriteByte('>')
+		case xml.CharData:
+			if skipDepth > 0 {
+				continue
+			}
+			if inStyle {
+				style.Write(token)
+			} else {
+				xml.EscapeText(&out, token)
+			}
+		case xml.ProcInst:
+			if token.Target == "xml" && out.Len() == 0 {
+				out.WriteString("<?xml ")
+				out.Write(token.Inst)
+				out.WriteString("?>")
+			}
+		}
+		// Comments and directives are dropped silently, since they aren't displayed.
+	}
+	return out.Bytes(), removed, nil
+}
+
+// qualifiedName returns the name, with its namespace prefix, as it appeared in the document.
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// svgElementAllowed returns true if the element is kept by sanitizeSvg.
+func svgElementAllowed(name xml.Name) bool {
+	return (name.Space == "" || name.Space == "svg") && svgAllowedElements[name.Local]
+}
+
+// svgAttributeAllowed returns true if the attribute of the given element is kept by sanitizeSvg.
+func svgAttributeAllowed(element string, attr xml.Attr) bool {
+	name := attr.Name.Local
+	if attr.Name.Space == "xmlns" {
+		// Only declare the namespaces we keep.
+		uri, ok := svgAllowedNamespaceURIs[name]
+		return ok && strings.TrimSpace(attr.Value) == uri
+	}
+	if attr.Name.Space != "" {
+		if !svgAllowedPrefixedAttributes[attr.Name] {
+			return false
+		}
+	} else if !svgAllowedAttributes[name] && !strings.HasPrefix(name, "aria-") && !strings.HasPrefix(name, "data-") {
+		return false
+	}
+
+	value := strings.TrimSpace(attr.Value)
+	switch {
+	case name == "href":
+		return strings.HasPrefix(value, "#") ||
+			element == "image" && strings.HasPrefix(strings.ToLower(value), "data:image/") &&
+				!strings.HasPrefix(strings.ToLower(value), "data:image/svg")
+	case name == "xmlns" && attr.Name.Space == "":
+		return value == svgNamespace
+	case name == "style":
+		return cssSafe(value)
+	}
+	// Presentation attributes are parsed as CSS, so may contain escapes too.
+	if strings.Contains(value, `\`) {
+		return false
+	}
+	return !strings.Contains(strings.ToLower(value), "url(") || localURLs(value)
+}
+
+// cssSafe returns true if CSS can't load other resources or run scripts.
+//
+// CSS containing a backslash is never safe: escapes such as "u\72l(" and "@\69mport" are decoded by
+// browsers, but would get past the checks for "url(" and "@import".
+func cssSafe(css string) bool {
+	if strings.Contains(css, `\`) {
+		return false
+	}
+	lower := strings.ToLower(css)
+	unsafeParts := []string{
+		"@import", "expression(", "javascript:", "behavior:", "-moz-binding", "image-set(",
+	}
+	for _, unsafe := range unsafeParts {
+		if strings.Contains(lower, unsafe) {
+			return false
+		}
+	}
+	return localURLs(css)
+}
+
+// localURLs returns true if every url() in a value refers to a fragment within the document.
+func localURLs(value string) bool {
+	lower := strings.ToLower(value)
+	for {
+		idx := strings.Index(lower, "url(")
+		if idx < 0 {
+			return true
+		}
+		lower = lower[idx+len("url("):]
+		target := strings.TrimLeft(lower, " \t\r\n'\"")
+		if !strings.HasPrefix(target, "#") {
+			return false
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package iconscraper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeSvg(t *testing.T) {
+	tests := []struct {
+		svg, expected string
+		removed       []string
+	}{
+		{
+			`<?xml version="1.0"?><!DOCTYPE svg><!-- comment --><svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24"><path d="M0 0h24v24z" fill="red"/></svg>`,
+			`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24"><path d="M0 0h24v24z" fill="red"></path></svg>`,
+			nil,
+		},
+		{
+			`<svg onload="alert(1)"><script>alert(2)</script><g><foreignObject><div>hi</div></foreignObject><rect onclick="alert(3)" width="1"/></g></svg>`,
+			`<svg><g><rect width="1"></rect></g></svg>`,
+			[]string{"onload", "<script>", "<foreignObject>", "onclick"},
+		},
+		{
+			`<svg xmlns:xlink="http://www.w3.org/1999/xlink"><use xlink:href="#a"/><use href="https://evil.test/x.svg#a"/><a href="javascript:alert(1)"><rect/></a><image href="data:image/png;base64,AAAA"/><image href="data:image/svg+xml;base64,AAAA"/></svg>`,
+			`<svg xmlns:xlink="http://www.w3.org/1999/xlink"><use xlink:href="#a"></use><use></use><image href="data:image/png;base64,AAAA"></image><image></image></svg>`,
+			[]string{"href", "<a>"},
+		},
+		{
+			`<svg><style>.a{fill:url(#g)} .b > .c{fill:red}</style><style>@import url(https://evil.test/x.css);</style><rect fill="url(#g)" style="fill:url(https://evil.test/track)" mask="url( 'https://evil.test' )"/></svg>`,
+			`<svg><style>.a{fill:url(#g)} .b &gt; .c{fill:red}</style><style></style><rect fill="url(#g)"></rect></svg>`,
+			[]string{"stylesheet", "style", "mask"},
+		},
+		{
+			`<svg><rect style="fill:u\72l(https://evil.test/t)" fill="u\rl(https://evil.test/t)" stroke="url(#g)"/><style>@\69mport 'https://evil.test/x.css';</style><style>.a{background:image-set("https://evil.test/x.png" 1x)}</style></svg>`,
+			`<svg><rect stroke="url(#g)"></rect><style></style><style></style></svg>`,
+			[]string{"style", "fill", "stylesheet"},
+		},
+		{
+			`<svg xmlns:inkscape="http://www.inkscape.org/namespaces/inkscape" inkscape:version="1"><inkscape:grid/><svg:rect width="1" xml:space="preserve" aria-label="x"/></svg>`,
+			`<svg><svg:rect width="1" xml:space="preserve" aria-label="x"></svg:rect></svg>`,
+			[]string{"xmlns:inkscape", "inkscape:version", "<inkscape:grid>"},
+		},
+		{
+			`<svg xmlns:xlink="http://www.w3.org/1999/xlink"><use xlink:href="#a" xlink:show="new" xlink:actuate="onLoad" xlink:role="x" xlink:arcrole="x" xlink:type="simple" xlink:title="t"/></svg>`,
+			`<svg xmlns:xlink="http://www.w3.org/1999/xlink"><use xlink:href="#a" xlink:title="t"></use></svg>`,
+			[]string{"xlink:show", "xlink:actuate", "xlink:role", "xlink:arcrole", "xlink:type"},
+		},
+		{
+			`<svg xmlns:xlink="https://evil.test/xlink" xmlns:svg="https://evil.test/svg"><text xml:lang="en" xml:space="preserve" xml:base="https://evil.test/" xml:id="t">hi</text></svg>`,
+			`<svg><text xml:lang="en" xml:space="preserve">hi</text></svg>`,
+			[]string{"xmlns:xlink", "xmlns:svg", "xml:base", "xml:id"},
+		},
+	}
+	for _, test := range tests {
+		sanitized, removed, err := sanitizeSvg([]byte(test.svg))
+		if err != nil {
+			t.Error(test.svg, err)
+			continue
+		}
+		if string(sanitized) != test.expected {
+			t.Errorf("expected\n%s\ngot\n%s", test.expected, sanitized)
+		}
+		if fmt.Sprint(removed) != fmt.Sprint(test.removed) {
+			t.Errorf("expected to remove %v, got %v", test.removed, removed)
+		}
+	}
+
+	if _, _, err := sanitizeSvg([]byte(`<svg><rect</svg>`)); err == nil {
+		t.Error("expected an error for invalid XML")
+	}
+}
+
+func TestSanitizeSvgIcons(t *testing.T) {
+	server := newTestServer(t, map[string]testSite{
+		"script.test": {
+			"/":         htmlPage(`<link rel="icon" href="/logo.svg">`),
+			"/logo.svg": {body: []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24" onload="alert(1)"><script>alert(2)</script><rect width="24" height="24"/></svg>`)},
+		},
+	})
+	warnings := make(chan error, 16)
+	config := Config{
+		AllowSvg:              true,
+		SanitizeSvg:           true,
+		MaxConcurrentRequests: 4,
+		HTTPClient:            &http.Client{Transport: server.transport()},
+		Warnings:              warnings,
+	}
+	icon, err := GetIconContext(context.Background(), config, "script.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if icon == nil || icon.Type != svgMimeType || icon.ImageConfig.Height != 24 {
+		t.Fatal("expected the SVG, got", icon)
+	}
+	if source := string(icon.Source); strings.Contains(source, "alert") || !strings.Contains(source, "<rect") {
+		t.Error("expected the script to be removed, got", source)
+	}
+
+	close(warnings)
+	var sanitized *SvgSanitizedError
+	for warning := range warnings {
+		if errors.As(warning, &sanitized) {
+			break
+		}
+	}
+	if sanitized == nil || sanitized.URL != "https://script.test/logo.svg" || fmt.Sprint(sanitized.Removed) != "[onload <script>]" {
+		t.Error("expected a sanitized warning, got", sanitized)
+	}
+}
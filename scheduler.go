@@ -0,0 +1,127 @@
+package iconscraper
+
+import (
+	"context"
+	"sync"
+)
+
+// domainKey is the context key for the domain a request is being made on behalf of.
+type domainKey struct{}
+
+// withDomain returns a context recording that requests made with it are on behalf of domain.
+func withDomain(ctx context.Context, domain string) context.Context {
+	return context.WithValue(ctx, domainKey{}, domain)
+}
+
+// domainFrom returns the domain recorded in ctx by withDomain, or "" if there isn't one.
+func domainFrom(ctx context.Context) string {
+	domain, _ := ctx.Value(domainKey{}).(string)
+	return domain
+}
+
+// numPriorities is the number of job priorities.
+const numPriorities = 2
+
+// priority returns the priority of a job for a kind of resource, where 0 is handed out first.
+//
+// HTML pages and manifests come first, since they lead to the images, and so getting them early
+// keeps every domain in the batch progressing.
+func (kind resourceKind) priority() int {
+	if kind == resourceImage {
+		return 1
+	}
+	return 0
+}
+
+// jobQueue holds jobs waiting for a worker, handing them out fairly.
+//
+// Jobs are handed out in priority order, and round-robin across domains within each priority, so a
+// domain with many icons can't starve the others.
+//
+// It is safe for concurrent use.
+type jobQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// queues for each priority.
+	queues [numPriorities]roundRobin
+	// closed is true once no more jobs will be pushed.
+	closed bool
+}
+
+func newJobQueue() *jobQueue {
+	queue := &jobQueue{}
+	queue.cond = sync.NewCond(&queue.mu)
+	for idx := range queue.queues {
+		queue.queues[idx].pending = make(map[string][]httpJob)
+	}
+	return queue
+}
+
+// push adds a job to the queue.
+func (queue *jobQueue) push(job httpJob) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.queues[job.kind.priority()].push(domainFrom(job.ctx), job)
+	queue.cond.Signal()
+}
+
+// pop waits for and removes the next job from the queue.
+//
+// Once the queue has been closed and emptied, false is returned.
+func (queue *jobQueue) pop() (httpJob, bool) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	for {
+		for idx := range queue.queues {
+			if job, ok := queue.queues[idx].pop(); ok {
+				return job, true
+			}
+		}
+		if queue.closed {
+			return httpJob{}, false
+		}
+		queue.cond.Wait()
+	}
+}
+
+// close the queue, waking all waiting workers. Jobs already pushed are still handed out.
+func (queue *jobQueue) close() {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.closed = true
+	queue.cond.Broadcast()
+}
+
+// roundRobin holds jobs grouped by domain, taking one job from each domain in turn.
+type roundRobin struct {
+	// order of the domains with pending jobs, the next job is taken from the first.
+	order []string
+	// pending jobs for each domain, in the order they were pushed.
+	pending map[string][]httpJob
+}
+
+func (rr *roundRobin) push(domain string, job httpJob) {
+	jobs, ok := rr.pending[domain]
+	if !ok {
+		rr.order = append(rr.order, domain)
+	}
+	rr.pending[domain] = append(jobs, job)
+}
+
+func (rr *roundRobin) pop() (httpJob, bool) {
+	if len(rr.order) == 0 {
+		return httpJob{}, false
+	}
+	domain := rr.order[0]
+	rr.order = rr.order[1:]
+	jobs := rr.pending[domain]
+	job := jobs[0]
+	if len(jobs) > 1 {
+		// Move the domain to the back of the line.
+		rr.pending[domain] = jobs[1:]
+		rr.order = append(rr.order, domain)
+	} else {
+		delete(rr.pending, domain)
+	}
+	return job, true
+}
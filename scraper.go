@@ -76,14 +76,61 @@
 //
 // Icons can be scraped for a single domain using `GetIcon`. Errors and warnings are handled in the
 // same way.
+//
+// # Cancellation and deadlines
+//
+// `GetIconsContext` and `GetIconContext` accept a `context.Context`. When the context is cancelled or
+// its deadline passes, outstanding requests are abandoned and the icons found so far are returned
+// along with the context's error:
+//
+//     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+//     defer cancel()
+//
+//     icons, err := iconscraper.GetIconsContext(ctx, config, domains)
+//     if err != nil {
+//         // Some domains may be missing from icons
+//     }
+//
+// # Streaming results
+//
+// `StreamIcons` sends the result for each domain as soon as it's ready, rather than collecting them
+// all into a map, so icons can be stored (and released) as the scrape progresses:
+//
+//     for res := range iconscraper.StreamIcons(ctx, config, domains) {
+//         if res.Icon != nil {
+//             store(res.Domain, res.Icon.Source)
+//         }
+//     }
+//
+// # Reusing a scraper
+//
+// A `Scraper` keeps its HTTP connections, robots.txt files and rate limits between calls. With
+// `ResultCacheSize` set, it also caches the icon selected for each domain:
+//
+//     config.ResultCacheSize = 10000
+//     scraper := iconscraper.NewScraper(config)
+//     defer scraper.Close()
+//
+//     icon, err := scraper.GetIcon(ctx, "mevitae.com")
+//
+// # Every candidate icon
+//
+// `GetCandidates` returns every icon found for a domain, rather than only the best, sorted with SVGs
+// first, then from largest to smallest:
+//
+//     candidates, err := iconscraper.GetCandidates(ctx, config, "mevitae.com")
 package iconscraper
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"image"
+	"image/color"
 	"log"
+	"net/http"
 	"regexp"
+	"time"
 
 	"golang.org/x/net/html"
 )
@@ -110,28 +157,220 @@ type Icon struct {
 	// Type is the sniffed MIME type of the image.
 	Type string
 
-	// Image holds the parsed image config. This is nil for SVGs (type image/svg+xml).
+	// Image holds the parsed image config. For SVGs (type image/svg+xml), it holds only the nominal
+	// size, from the width, height and viewBox of the root element, and is zero if that's unknown.
 	ImageConfig image.Config
 
 	// Source is the image source as downloaded.
 	Source []byte
+
+	// Provenance records where the icon was found.
+	Provenance Provenance
+
+	// Raster is a PNG rendering of an SVG icon, if Config.RasterizeSvg is set. It's nil for other
+	// icons, or if the SVG couldn't be rendered.
+	Raster *Icon
+
+	// Output is the icon resized to the target size and encoded as Config.OutputType, if
+	// Config.Resize is set. It's nil if the icon couldn't be decoded.
+	Output *Icon
+
+	// Padded is true if the icon isn't square, but was selected because Config.PadToSquare is set
+	// and there were no square icons. Its Output is the icon centred on a square canvas.
+	Padded bool
 }
 
 // Config is the config used for GetIcons and GetIcon.
 type Config struct {
-	// SquareOnly determines if only square icons are considered.
+	// SquareOnly determines if only square icons are considered. It's the same as an AspectRatio of
+	// 1, so AspectRatioTolerance can be used to accept icons that are nearly square.
 	SquareOnly bool
 
 	// TargetHeight of the icon to be fetched. The shortest image larger than this size will be
 	// returned and, if none are available, the tallest image smaller than this will be returned.
 	TargetHeight int
 
+	// TargetWidth of the icon to be fetched. If set, an image must be at least this wide, as well
+	// as TargetHeight tall, to meet the target.
+	TargetWidth int
+
+	// MinWidth, MinHeight, MaxWidth and MaxHeight bound the size of icons considered, in pixels.
+	// Each bound applies only if it's not zero. They don't apply to SVGs.
+	MinWidth, MinHeight int
+	MaxWidth, MaxHeight int
+
+	// AspectRatio, as width divided by height, of the icons considered. If zero, any aspect ratio is
+	// allowed. It's ignored if SquareOnly is set.
+	AspectRatio float64
+
+	// AspectRatioTolerance is how far an icon's aspect ratio may be from AspectRatio (or from 1 if
+	// SquareOnly is set), as a fraction of it. For example, 0.02 accepts a 180x181 icon as square. If
+	// zero, the aspect ratio must match exactly.
+	AspectRatioTolerance float64
+
+	// Targets are additional sizes to select icons for, each chosen from the same candidates as if
+	// it were TargetWidth and TargetHeight. They're returned by GetIconSet, GetIconSets and in
+	// Result.Set, so icons for several sizes can be found with a single scrape.
+	Targets []Target
+
 	// AllowSvg allows SVGs to be returned. An SVG will always supersede a non-vector image.
 	AllowSvg bool
 
+	// RasterizeSvg renders selected SVG icons to PNGs, set as their Raster, for consumers that can't
+	// display SVGs. They're rendered at TargetHeight (or, if that's zero, TargetWidth, or else
+	// their nominal size), keeping their aspect ratio.
+	//
+	// The renderer supports the paths, shapes, transforms and solid colors that most icons use, but
+	// not all of SVG. SVGs using anything else, like gradients, clipping, text, `<use>` or the
+	// even-odd fill rule, or too complex to draw cheaply, aren't rendered, and the next best icon
+	// is selected instead, if there is one. Rendering counts towards DomainTimeout.
+	RasterizeSvg bool
+
+	// Resize decodes the selected icon, resamples it to the target size, and encodes it as
+	// OutputType, set as the icon's Output. The original icon is kept.
+	//
+	// If TargetWidth and TargetHeight are both set, it's resized to exactly that size. Otherwise,
+	// it's resized to whichever is set, keeping its aspect ratio, or just re-encoded if neither is.
+	// SVGs are rasterized, keeping their aspect ratio, centred within the size.
+	Resize bool
+
+	// OutputType is the MIME type of the format resized icons are encoded in: "image/png",
+	// "image/jpeg", "image/gif" or "image/bmp". If empty, "image/png" is used.
+	OutputType string
+
+	// PadToSquare, if SquareOnly is also set, selects the best non-square icon when there are no
+	// square icons, rather than none. The icon is flagged as Padded, and its Output is the icon
+	// centred on a square canvas filled with PadColor. The canvas is the target size if Resize is
+	// set, or otherwise as large as the icon's longest side. If the padded Output can't be
+	// produced, no icon is selected.
+	PadToSquare bool
+
+	// PadColor is the background color of the canvas icons are padded or fitted onto. If nil,
+	// it's transparent. Since JPEGs don't support transparency, a transparent background is white
+	// in JPEG output.
+	PadColor color.Color
+
+	// TrimBorders crops transparent or uniformly colored borders from selected icons, so that they
+	// fill their Output consistently, before they're resized or padded. The border color is taken
+	// from the top left pixel. The trimmed icon is set as the Output, at its own size unless Resize
+	// is set. If it's resized to both TargetWidth and TargetHeight, it's scaled to fit within them,
+	// keeping its aspect ratio, and centred on a canvas of that size filled with PadColor.
+	TrimBorders bool
+
+	// TrimMargin is the margin left around trimmed icons, as a fraction of the longest side of their
+	// content, up to 1. For example, 0.1 leaves 10 pixels around 100 pixels of content.
+	TrimMargin float64
+
+	// TrimTolerance is how far, as a fraction of the range of each channel, a pixel's color can be
+	// from the border color to be trimmed. It allows for noise and anti-aliasing. If zero, only
+	// exactly matching pixels, or fully transparent pixels for transparent borders, are trimmed.
+	TrimTolerance float64
+
+	// SanitizeSvg removes anything that could run scripts or load other resources from SVG icons,
+	// so they can be displayed safely in a web page. Only an allow-list of elements and attributes
+	// is kept, and links must be within the image. A *SvgSanitizedError warning is reported for
+	// each SVG that had something removed.
+	SanitizeSvg bool
+
+	// Selector chooses the icon returned for each domain from the candidates found. If nil,
+	// DefaultSelector is used.
+	Selector Selector
+
 	// MaxConcurrentRequests sets the maximum number of concurrent HTTP requests.
 	MaxConcurrentRequests int
 
+	// MaxConcurrentRequestsPerHost limits the number of concurrent requests to a single host. If
+	// zero, only MaxConcurrentRequests applies.
+	MaxConcurrentRequestsPerHost int
+
+	// RequestsPerSecondPerHost limits the rate at which requests to a single host are started. If
+	// zero, there is no limit.
+	//
+	// Each request counts once, however many attempts it takes. Retries are spaced out by the
+	// RetryPolicy instead.
+	RequestsPerSecondPerHost float64
+
+	// RequestsPerSecond limits the rate at which requests to any host are started. If zero, there is
+	// no limit.
+	RequestsPerSecond float64
+
+	// RespectRobotsTxt makes the scraper fetch the robots.txt file for each host, and skip the URLs it
+	// disallows. Skipped URLs are reported as *RobotsDisallowedError warnings. If a host's
+	// robots.txt can't be fetched because the host is unreachable, nothing is fetched from it, and
+	// the network error is reported instead.
+	RespectRobotsTxt bool
+
+	// RobotsUserAgent is the product token used to find our rules in robots.txt files. If empty,
+	// "iconscraper" is used.
+	RobotsUserAgent string
+
+	// CacheDir is the directory in which to cache HTTP responses between scrapes. If empty, responses
+	// aren't cached.
+	//
+	// Cached responses are used until they're no longer fresh according to their Cache-Control and
+	// Expires headers, and then revalidated using their ETag and Last-Modified headers.
+	CacheDir string
+
+	// HTTPClient is the client used to make every request.
+	//
+	// If nil, a default client is used. A custom client can be used to add proxies or
+	// instrumentation, or to direct requests to local servers when testing.
+	HTTPClient *http.Client
+
+	// DialTimeout limits how long establishing a connection may take. If zero, a default of 10
+	// seconds is used. This, and TLSHandshakeTimeout, are ignored if HTTPClient is set.
+	DialTimeout time.Duration
+
+	// TLSHandshakeTimeout limits how long a TLS handshake may take. If zero, a default of 10 seconds
+	// is used.
+	TLSHandshakeTimeout time.Duration
+
+	// ResponseHeaderTimeout limits how long each attempt at a request may wait for the response
+	// headers, including the time taken to connect. If zero, a default of 15 seconds is used.
+	ResponseHeaderTimeout time.Duration
+
+	// BodyReadTimeout limits how long each attempt at a request may take to read the response body,
+	// once the headers have been received. If zero, a default of 30 seconds is used.
+	BodyReadTimeout time.Duration
+
+	// RetryPolicy determines how failed requests are retried. If nil, DefaultRetryPolicy is used.
+	RetryPolicy *RetryPolicy
+
+	// Clock is used to wait between retries, for rate limits and to determine the freshness of
+	// cached responses. If nil, the real clock is used.
+	Clock Clock
+
+	// MaxHTMLBytes limits the size of HTML pages. Larger pages are ignored, and reported as a
+	// *ResponseTooLargeError warning. If zero, a default of 5 MiB is used.
+	MaxHTMLBytes int64
+
+	// MaxManifestBytes limits the size of web app manifests. If zero, a default of 1 MiB is used.
+	MaxManifestBytes int64
+
+	// MaxImageBytes limits the size of images. If zero, a default of 5 MiB is used.
+	MaxImageBytes int64
+
+	// MaxImageDimension limits the width and height of images, in pixels. Larger images are ignored,
+	// and reported as a *ImageTooLargeError warning. If zero, a default of 4096 is used.
+	MaxImageDimension int
+
+	// DomainTimeout is the total time budget for each domain, covering its HTML page, manifests and
+	// images, and rasterizing or resizing the selected icon. When it runs out, outstanding requests
+	// are abandoned and the best icon found so far is used, without its Raster or Output if they
+	// weren't finished. If zero, there is no limit.
+	DomainTimeout time.Duration
+
+	// ResultCacheSize is the number of domains whose selected icon is cached by a Scraper. If zero,
+	// results aren't cached.
+	ResultCacheSize int
+
+	// ResultCacheTTL is how long a domain's icon is cached for. If zero, a default of an hour is used.
+	ResultCacheTTL time.Duration
+
+	// NegativeResultCacheTTL is how long a domain without an icon, including one that failed to be
+	// scraped, is cached for. If zero, a default of 5 minutes is used.
+	NegativeResultCacheTTL time.Duration
+
 	// Errors is the channel for receiving errors.
 	//
 	// If nil, errors will instead by logged to the default logger.
@@ -155,68 +394,264 @@ type Config struct {
 //
 // If no icon is not found for a domain (or no square icon if squareOnly is true), that domain is omitted from the output map.
 func GetIcons(config Config, domains []string) map[string]Icon {
+	icons, _ := GetIconsContext(context.Background(), config, domains)
+	return icons
+}
+
+// GetIconsContext is like GetIcons, but stops early if ctx is done.
+//
+// If ctx ends before every domain has been processed, the icons found so far are returned along with
+// ctx.Err(). Errors caused by the context ending are not sent to config.Errors.
+func GetIconsContext(ctx context.Context, config Config, domains []string) (map[string]Icon, error) {
+	resultMap := make(map[string]Icon, len(domains))
+	for res := range StreamIcons(ctx, config, domains) {
+		if res.Icon != nil {
+			resultMap[res.Domain] = *res.Icon
+		}
+	}
+	return resultMap, ctx.Err()
+}
+
+// GetIcons scrapes icons from the provided domain and finds the smallest icon taller than targetHeight or, if there are none, the tallest icon.
+//
+// Errors that occur are sent to the config.Errors, unless it's nil, in which case, they are logged.
+func GetIcon(config Config, domain string) *Icon {
+	icon, _ := GetIconContext(context.Background(), config, domain)
+	return icon
+}
+
+// GetIconContext is like GetIcon, but stops early if ctx is done.
+//
+// If ctx ends before the domain has been processed, the best icon found so far (if any) is returned
+// along with ctx.Err().
+func GetIconContext(ctx context.Context, config Config, domain string) (*Icon, error) {
+	var icon *Icon
+	for res := range StreamIcons(ctx, config, []string{domain}) {
+		icon = res.Icon
+	}
+	return icon, ctx.Err()
+}
+
+// Result is the outcome of scraping a single domain, as sent by StreamIcons.
+type Result struct {
+	// Domain is the domain that was processed, exactly as it was passed in.
+	Domain string
+
+	// Icon is the best icon found for the domain, or nil if there isn't one.
+	Icon *Icon
+
+	// Set holds the best icon for each of config.Targets. It's empty if no targets are set.
+	Set IconSet
+}
+
+// StreamIcons scrapes icons from the provided domains concurrently, sending the result for each
+// domain on the returned channel as soon as that domain has been processed.
+//
+// Exactly one result is sent for every domain, in the order they complete, then the channel is
+// closed. The channel must be drained, since scraping stalls while results aren't being received.
+//
+// If ctx ends, outstanding requests are abandoned and the remaining domains are sent promptly
+// with whichever icon (if any) was found before then.
+func StreamIcons(ctx context.Context, config Config, domains []string) <-chan Result {
+	scraper := NewScraper(config)
+	return scraper.stream(ctx, domains, scraper.Close)
+}
+
+// GetCandidates scrapes icons from the provided domain, and returns every icon that was
+// successfully fetched and decoded, rather than only the best. They're sorted with SVGs first, then
+// from largest to smallest.
+//
+// This can be used to offer alternatives to the icon chosen by GetIcon, or to rank icons
+// differently. If ctx ends before the domain has been processed, the icons found so far are
+// returned along with ctx.Err().
+func GetCandidates(ctx context.Context, config Config, domain string) ([]Icon, error) {
+	scraper := NewScraper(config)
+	defer scraper.Close()
+	return scraper.GetCandidates(ctx, domain)
+}
+
+// GetIconSet scrapes icons from the provided domain, and returns the best icon for each of
+// config.Targets, choosing them all from a single set of candidates.
+//
+// If ctx ends before the domain has been processed, the icons found so far are returned along with
+// ctx.Err().
+func GetIconSet(ctx context.Context, config Config, domain string) (IconSet, error) {
+	scraper := NewScraper(config)
+	defer scraper.Close()
+	return scraper.GetIconSet(ctx, domain)
+}
+
+// GetIconSets is like GetIconSet, but for many domains concurrently, returning a map from domain to
+// its set. Domains without any icons are omitted.
+func GetIconSets(ctx context.Context, config Config, domains []string) (map[string]IconSet, error) {
+	scraper := NewScraper(config)
+	defer scraper.Close()
+	return scraper.GetIconSets(ctx, domains)
+}
+
+// Scraper scrapes icons with a long-lived HTTP worker pool, so connections, robots.txt files and
+// rate limits are shared between calls. If config.ResultCacheSize is set, it also caches the icon
+// selected for each domain, so repeated lookups are served from memory.
+//
+// It is safe for concurrent use. Close must be called once it's no longer needed.
+type Scraper struct {
+	config Config
+
+	// http is the pool used for every request.
+	http *httpWorkerPool
+
+	// cache of selected icons, or nil if result caching is disabled.
+	cache *resultCache
+
+	// closeChannels are the default error and warning channels, if they were created, to be closed
+	// by Close.
+	closeChannels []chan error
+}
+
+// NewScraper creates a scraper using config.
+//
+// If config.Errors or config.Warnings are nil, they're logged until the scraper is closed.
+func NewScraper(config Config) *Scraper {
+	scraper := &Scraper{}
+
 	// Create error and warning handler channels if not provided. By default, these are consumed and logged.
 	if config.Errors == nil {
 		config.Errors = make(chan error)
 		go logErrors(config.Errors)
-		defer close(config.Errors)
+		scraper.closeChannels = append(scraper.closeChannels, config.Errors)
 	}
 	if config.Warnings == nil {
 		config.Warnings = make(chan error)
 		go logWarnings(config.Warnings)
-		defer close(config.Warnings)
+		scraper.closeChannels = append(scraper.closeChannels, config.Warnings)
 	}
 
-	// HTTP worker pool
-	http := newHttpWorkerPool(config.MaxConcurrentRequests)
-	defer http.close()
+	scraper.config = config
+	scraper.http = newHttpWorkerPool(config)
+	scraper.cache = newResultCache(config, scraper.http.clock)
+	return scraper
+}
 
-	// Channel to collect results
-	results := make(chan processReturn)
-	defer close(results)
+// Close waits for outstanding requests to finish and stops the scraper's workers. The scraper must
+// not be used afterwards.
+func (scraper *Scraper) Close() {
+	scraper.http.close()
+	for _, ch := range scraper.closeChannels {
+		close(ch)
+	}
+}
 
-	// Spawn a goroutine for every domain, these will be rate limited by the http pool.
-	for _, domain := range domains {
-		go processDomain(config, domain, http, results)
+// GetIcon is like GetIconContext, using the scraper's config.
+//
+// The returned icon may be shared with other callers, so must not be modified.
+func (scraper *Scraper) GetIcon(ctx context.Context, domain string) (*Icon, error) {
+	var icon *Icon
+	for res := range scraper.stream(ctx, []string{domain}, nil) {
+		icon = res.Icon
 	}
+	return icon, ctx.Err()
+}
 
-	// Collect results
-	resultMap := make(map[string]Icon, len(domains))
-	for idx := 0; idx < len(domains); idx++ {
-		res := <-results
-		if res.result != nil {
-			resultMap[res.domain] = *res.result
-		}
+// GetCandidates is like the package level GetCandidates, using the scraper's config.
+//
+// Candidates aren't cached.
+func (scraper *Scraper) GetCandidates(ctx context.Context, domain string) ([]Icon, error) {
+	domainCtx, cancel := domainContext(ctx, scraper.config, domain)
+	defer cancel()
+	candidates := getCandidates(domainCtx, scraper.config, domain, scraper.http)
+	reportDomainTimeout(ctx, domainCtx, scraper.config, domain)
+	return candidates, ctx.Err()
+}
+
+// GetIconSet is like the package level GetIconSet, using the scraper's config.
+//
+// The returned icons may be shared with other callers, so must not be modified.
+func (scraper *Scraper) GetIconSet(ctx context.Context, domain string) (IconSet, error) {
+	var set IconSet
+	for res := range scraper.stream(ctx, []string{domain}, nil) {
+		set = res.Set
 	}
-	return resultMap
+	return set, ctx.Err()
 }
 
-// GetIcons scrapes icons from the provided domain and finds the smallest icon taller than targetHeight or, if there are none, the tallest icon.
+// GetIconSets is like the package level GetIconSets, using the scraper's config.
 //
-// Errors that occur are sent to the config.Errors, unless it's nil, in which case, they are logged.
-func GetIcon(config Config, domain string) *Icon {
-	// Create error and warning handler channels if not provided. By default, these are consumed and logged.
-	if config.Errors == nil {
-		config.Errors = make(chan error)
-		go logErrors(config.Errors)
-		defer close(config.Errors)
+// The returned icons may be shared with other callers, so must not be modified.
+func (scraper *Scraper) GetIconSets(ctx context.Context, domains []string) (map[string]IconSet, error) {
+	resultMap := make(map[string]IconSet, len(domains))
+	for res := range scraper.stream(ctx, domains, nil) {
+		if len(res.Set) != 0 {
+			resultMap[res.Domain] = res.Set
+		}
 	}
-	if config.Warnings == nil {
-		config.Warnings = make(chan error)
-		go logWarnings(config.Warnings)
-		defer close(config.Warnings)
+	return resultMap, ctx.Err()
+}
+
+// GetIcons is like GetIconsContext, using the scraper's config.
+func (scraper *Scraper) GetIcons(ctx context.Context, domains []string) (map[string]Icon, error) {
+	resultMap := make(map[string]Icon, len(domains))
+	for res := range scraper.stream(ctx, domains, nil) {
+		if res.Icon != nil {
+			resultMap[res.Domain] = *res.Icon
+		}
 	}
+	return resultMap, ctx.Err()
+}
+
+// StreamIcons is like the package level StreamIcons, using the scraper's config.
+//
+// The icons sent may be shared with other callers, so must not be modified.
+func (scraper *Scraper) StreamIcons(ctx context.Context, domains []string) <-chan Result {
+	return scraper.stream(ctx, domains, nil)
+}
 
-	// HTTP worker pool
-	http := newHttpWorkerPool(config.MaxConcurrentRequests)
-	defer http.close()
+// stream implements StreamIcons, calling done (if not nil) once every domain has been processed,
+// before closing the returned channel.
+func (scraper *Scraper) stream(ctx context.Context, domains []string, done func()) <-chan Result {
+	out := make(chan Result)
+	go func() {
+		defer close(out)
+		if done != nil {
+			defer done()
+		}
 
-	// Channel to collect results
-	results := make(chan processReturn, 1)
-	defer close(results)
+		// Channel to collect results
+		results := make(chan processReturn)
+		defer close(results)
+
+		// Spawn a goroutine for every domain which isn't cached, these will be rate limited by the
+		// http pool.
+		//
+		// Once ctx is done, every request fails immediately, so these all finish promptly.
+		pending := 0
+		for _, domain := range domains {
+			if scraper.cache != nil {
+				if res, ok := scraper.cache.get(domain); ok {
+					res.Domain = domain
+					out <- res
+					continue
+				}
+			}
+			pending++
+			go processDomain(ctx, scraper.config, domain, scraper.http, results)
+		}
 
-	go processDomain(config, domain, http, results)
-	return (<-results).result
+		// Forward results as they arrive
+		for idx := 0; idx < pending; idx++ {
+			res := <-results
+			result := Result{
+				Domain: res.domain,
+				Icon:   res.result,
+				Set:    res.set,
+			}
+			// Don't cache results cut short by the caller or the domain timeout.
+			if scraper.cache != nil && !res.incomplete {
+				scraper.cache.put(res.domain, result)
+			}
+			out <- result
+		}
+	}()
+	return out
 }
 
 // processReturn is the output of processDomain
@@ -226,6 +661,13 @@ type processReturn struct {
 
 	// result holds the result, or nil if there isn't one.
 	result *Icon
+
+	// set holds the result for each of config.Targets.
+	set IconSet
+
+	// incomplete is true if processing was cut short, by the caller or config.DomainTimeout, so a
+	// better icon may have been missed.
+	incomplete bool
 }
 
 var domainNameRegexp = regexp.MustCompile(`^([a-zA-Z0-9_][a-zA-Z0-9_-]{0,64})(\.[a-zA-Z0-9_][a-zA-Z0-9_-]{0,64})*[\._]?$`)
@@ -237,62 +679,122 @@ func couldBeDomain(domain string) bool {
 
 // processDomain is a worker function that processes getting images for a domain.
 //
-// It fetches HTML content from each URL, parses the HTML content, and extracts
-// image information based on keys and values variables. It then picks the best
-// image from the extracted images based on the `bestSize` parameter and sends
-// the best image back on the result channel, or, if not image was found, it
-// sends back a nil result.
+// It sends the best image found for the domain back on the result channel, or, if no image was
+// found, it sends back a nil result. The best image for each of config.Targets is sent with it.
+// Finishing the selected images, such as rasterizing SVGs, counts towards config.DomainTimeout.
 func processDomain(
+	ctx context.Context,
 	config Config,
 	domain string,
 	http *httpWorkerPool,
 	result chan processReturn,
 ) {
+	domainCtx, cancel := domainContext(ctx, config, domain)
+	defer cancel()
+	candidates := getCandidates(domainCtx, config, domain, http)
+
+	// Pick the best size image from all the results.
+	finished := make(map[finishKey]*Icon)
+	icon := selectIcon(domainCtx, config, candidates, finished)
+	var set IconSet
+	if len(config.Targets) != 0 {
+		set = pickIconSet(domainCtx, config, candidates, finished)
+	}
+	reportDomainTimeout(ctx, domainCtx, config, domain)
+	result <- processReturn{
+		domain:     domain,
+		result:     icon,
+		set:        set,
+		incomplete: domainCtx.Err() != nil,
+	}
+}
+
+// finishIcon returns a copy of the selected icon, so that the other candidates aren't kept in memory
+// with it, rasterizing it if it's an SVG and config.RasterizeSvg is set, and resizing it if
+// config.Resize is set or it's to be padded to a square. Failures caused by ctx ending aren't
+// reported.
+func finishIcon(ctx context.Context, config Config, best *Icon, padded bool) *Icon {
+	icon := *best
+	icon.Padded = padded
+	if config.RasterizeSvg && icon.Type == svgMimeType {
+		raster, err := rasterizeIcon(ctx, config, &icon)
+		if err != nil && ctx.Err() == nil {
+			config.Warnings <- fmt.Errorf("Failed to rasterize SVG %s: %w", icon.URL, err)
+		}
+		icon.Raster = raster
+	}
+	if config.Resize || config.TrimBorders || padded {
+		output, err := outputIcon(ctx, config, &icon)
+		if err != nil && ctx.Err() == nil {
+			config.Warnings <- fmt.Errorf("Failed to resize icon %s: %w", icon.URL, err)
+		}
+		icon.Output = output
+	}
+	return &icon
+}
+
+// domainContext returns the context for processing a domain, within config.DomainTimeout, if set.
+func domainContext(ctx context.Context, config Config, domain string) (context.Context, context.CancelFunc) {
+	// Requests for this domain are scheduled fairly alongside the other domains.
+	domainCtx := withDomain(ctx, domain)
+	if config.DomainTimeout > 0 {
+		return context.WithTimeout(domainCtx, config.DomainTimeout)
+	}
+	return context.WithCancel(domainCtx)
+}
+
+// reportDomainTimeout reports running out of time processing a domain, unless it was the caller's
+// context, ctx, that ended.
+func reportDomainTimeout(ctx, domainCtx context.Context, config Config, domain string) {
+	if domainCtx.Err() != nil && ctx.Err() == nil {
+		config.Errors <- fmt.Errorf("Ran out of time processing %s after %s", domain, config.DomainTimeout)
+	}
+}
+
+// getCandidates gets images for a domain.
+//
+// It fetches HTML content from each URL, parses the HTML content, and extracts
+// image information based on keys and values variables. It returns every image
+// which was successfully fetched and decoded, sorted by sortCandidates.
+func getCandidates(ctx context.Context, config Config, domain string, http *httpWorkerPool) []Icon {
 	// Check for obvious cases where the domain passed is invalid
 	if !couldBeDomain(domain) {
 		config.Errors <- fmt.Errorf("Invalid domain name %s", domain)
-		result <- processReturn{
-			domain: domain,
-			result: nil,
-		}
+		return nil
 	}
 
 	url := "https://" + domain
-	httpResult := http.get(url)
+	httpResult := http.get(ctx, url, resourceHTML)
 	// Only check for network errors fetching, if it's an error page, that'll do.
 	if httpResult.err != nil {
-		config.Errors <- fmt.Errorf("Failed to get %s: %w", url, httpResult.err)
-		result <- processReturn{
-			domain: domain,
-			result: nil,
+		if ctx.Err() == nil {
+			reportFetchError(config.Errors, config.Warnings, fmt.Errorf("Failed to get %s: %w", url, httpResult.err))
 		}
-		return
+		return nil
 	}
 
 	// Parse the output HTML
 	doc, err := html.Parse(bytes.NewReader(httpResult.body))
 	if err != nil {
 		config.Errors <- fmt.Errorf("Error parsing HTML from %s: %w", url, err)
-		result <- processReturn{
-			domain: domain,
-			result: nil,
-		}
-		return
+		return nil
 	}
 
 	// Our requests will be now rooted at the domain we were redirected to.
 	redirectDomain := httpResult.url.Host
 	url = "https://" + redirectDomain
 
-	workers := newImageWorkers(redirectDomain, http, config.Errors, config.Warnings)
-	// Always check for `/favicon.ico`, it's not always linked from the HTML.
-	workers.spawn(url + "/favicon.ico")
-	// Spawn workers scraping all the linked icons
-	getImagesFromHTML(doc, redirectDomain, &workers)
-
-	// Pick the best size image from all the results
-	result <- processReturn{
-		domain: domain,
-		result: pickBestImage(config, workers.results()),
+	workers := newImageWorkers(ctx, config, redirectDomain, http)
+	// Always check for `/favicon.ico`, it's not always linked from the HTML. It's spawned first so
+	// it doesn't wait for the manifests. If it's linked too, the provenance records the link.
+	workers.spawn(url+"/favicon.ico", Provenance{Kind: SourceFavicon})
+	// Spawn workers scraping all the linked icons, then those in the linked manifests.
+	manifests := getImagesFromHTML(doc, redirectDomain, httpResult.url.String(), &workers)
+	for _, manifestURL := range manifests {
+		processManifest(redirectDomain, manifestURL, &workers)
 	}
+
+	candidates := workers.results()
+	sortCandidates(candidates)
+	return candidates
 }
@@ -1,10 +1,229 @@
 package iconscraper
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
+// skipUnlessLive skips tests that scrape real websites, unless ICONSCRAPER_LIVE_TESTS is set.
+func skipUnlessLive(t *testing.T) {
+	if os.Getenv("ICONSCRAPER_LIVE_TESTS") == "" {
+		t.Skip("set ICONSCRAPER_LIVE_TESTS=1 to scrape real websites")
+	}
+}
+
+// testResponse is a response served by a test site.
+type testResponse struct {
+	status   int
+	header   http.Header
+	body     []byte
+	location string
+	// delay before responding
+	delay time.Duration
+	// release, if set, must be closed before responding.
+	release chan struct{}
+}
+
+// testSite maps request paths to the responses served for them. Unknown paths are a 404.
+type testSite map[string]testResponse
+
+// testServer is a TLS server hosting test sites.
+type testServer struct {
+	*httptest.Server
+
+	// conns counts the connections accepted by the server.
+	conns int64
+	// requests counts the requests received by the server.
+	requests int64
+	// notModified counts the requests the server responded to with 304 Not Modified.
+	notModified int64
+}
+
+// newTestServer starts a TLS server hosting sites, keyed by host name.
+func newTestServer(t testing.TB, sites map[string]testSite) *testServer {
+	server := &testServer{}
+	server.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&server.requests, 1)
+		res, ok := sites[r.Host][r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		select {
+		case <-time.After(res.delay):
+		case <-r.Context().Done():
+			return
+		}
+		if res.release != nil {
+			select {
+			case <-res.release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		for key, values := range res.header {
+			w.Header()[key] = values
+		}
+		if res.location != "" {
+			w.Header().Set("Location", res.location)
+		}
+		if etag := res.header.Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+			atomic.AddInt64(&server.notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		status := res.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		w.WriteHeader(status)
+		w.Write(res.body)
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&server.conns, 1)
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// transport returns the transport used by the scraper, modified to send every request to the
+// server, whatever the host.
+func (server *testServer) transport() *http.Transport {
+	addr := server.Listener.Addr().String()
+	transport := newTransport(Config{})
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return transport
+}
+
+// newTestClient starts a TLS server hosting sites, keyed by host name, and returns a client which
+// sends every request to that server, whatever the host.
+func newTestClient(t testing.TB, sites map[string]testSite) *http.Client {
+	return &http.Client{Transport: newTestServer(t, sites).transport()}
+}
+
+// htmlPage returns a response with a HTML page containing head in its <head>.
+func htmlPage(head string) testResponse {
+	return testResponse{body: []byte("<!DOCTYPE html><html><head>" + head + "</head><body></body></html>")}
+}
+
+// pngImage returns a response with a blank PNG of the given size.
+func pngImage(width, height int) testResponse {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height)))
+	return testResponse{body: buf.Bytes()}
+}
+
+// svgImage is a response with a small square SVG.
+var svgImage = testResponse{body: []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24"><rect width="24" height="24" fill="red"/></svg>`)}
+
+// testSites are a handful of sites to scrape offline.
+var testSites = map[string]testSite{
+	"icons.test": {
+		"/":              htmlPage(`<link rel="icon" href="/icon-32.png" sizes="32x32" type="image/png"><link rel="apple-touch-icon" href="icon-180.png"><link rel="manifest" href="/manifest.json">`),
+		"/favicon.ico":   pngImage(16, 16),
+		"/icon-32.png":   pngImage(32, 32),
+		"/icon-180.png":  pngImage(180, 180),
+		"/manifest.json": {body: []byte(`{"name":"Icons","icons":[{"src":"/icon-144.png","sizes":"144x144","purpose":"any"},{"src":"https://cdn.test/icon-512.png"}]}`)},
+		"/icon-144.png":  pngImage(144, 144),
+		"/logo.svg":      svgImage,
+	},
+	"cdn.test": {
+		"/icon-512.png": pngImage(512, 512),
+	},
+	"redirect.test": {
+		"/": {status: http.StatusMovedPermanently, location: "https://www.redirect.test/"},
+	},
+	"www.redirect.test": {
+		"/":            htmlPage(`<meta itemprop="image" content="/image.png">`),
+		"/image.png":   pngImage(64, 64),
+		"/favicon.ico": {status: http.StatusNotFound},
+	},
+	"svg.test": {
+		"/":         htmlPage(`<link rel="icon" href="/logo.svg"><link rel="shortcut icon" href="/icon.png">`),
+		"/logo.svg": svgImage,
+		"/icon.png": pngImage(48, 48),
+	},
+	"wide.test": {
+		"/":         htmlPage(`<link rel="icon" href="/wide.png">`),
+		"/wide.png": pngImage(200, 100),
+	},
+	"empty.test": {
+		"/": htmlPage(``),
+	},
+	"large.test": {
+		"/":         htmlPage(`<link rel="icon" href="/huge.png"><link rel="icon" href="/wide.png"><link rel="icon" href="/ok.png">`),
+		"/huge.png": {body: bytes.Repeat([]byte{0}, 8192)},
+		"/wide.png": pngImage(300, 300),
+		"/ok.png":   pngImage(32, 32),
+	},
+	"slow.test": {
+		"/":         htmlPage(`<link rel="icon" href="/slow.png"><link rel="icon" href="/fast.png">`),
+		"/slow.png": {delay: time.Hour},
+		"/fast.png": pngImage(32, 32),
+	},
+}
+
+func TestOffline(t *testing.T) {
+	config := Config{
+		SquareOnly:            true,
+		TargetHeight:          128,
+		MaxConcurrentRequests: 4,
+		AllowSvg:              false,
+		HTTPClient:            newTestClient(t, testSites),
+	}
+	icons := GetIcons(config, []string{"icons.test", "redirect.test", "svg.test", "wide.test", "empty.test", "missing.test"})
+	if icon, ok := icons["icons.test"]; !ok || icon.ImageConfig.Height != 144 {
+		t.Error("didn't find icon for icons.test", ok, icon.URL, icon.ImageConfig)
+	}
+	if icon, ok := icons["redirect.test"]; !ok || icon.URL != "https://www.redirect.test/image.png" {
+		t.Error("didn't find icon for redirect.test", ok, icon.URL, icon.ImageConfig)
+	}
+	if icon, ok := icons["svg.test"]; !ok || icon.ImageConfig.Height != 48 {
+		t.Error("didn't find icon for svg.test", ok, icon.URL, icon.ImageConfig)
+	}
+	for _, domain := range []string{"wide.test", "empty.test", "missing.test"} {
+		if icon, ok := icons[domain]; ok {
+			t.Error("found icon for", domain, icon.URL, icon.ImageConfig)
+		}
+	}
+
+	config.SquareOnly = false
+	config.AllowSvg = true
+	config.TargetHeight = 600
+	icons = GetIcons(config, []string{"icons.test", "svg.test", "wide.test"})
+	if icon, ok := icons["icons.test"]; !ok || icon.URL != "https://cdn.test/icon-512.png" {
+		t.Error("didn't find largest icon for icons.test", ok, icon.URL, icon.ImageConfig)
+	}
+	if icon, ok := icons["svg.test"]; !ok || icon.Type != svgMimeType {
+		t.Error("didn't find SVG icon for svg.test", ok, icon.URL, icon.Type)
+	}
+	if icon, ok := icons["wide.test"]; !ok || icon.ImageConfig.Width != 200 {
+		t.Error("didn't find wide icon for wide.test", ok, icon.URL, icon.ImageConfig)
+	}
+}
+
 func TestSomeSites(t *testing.T) {
+	skipUnlessLive(t)
 	config := Config{
 		SquareOnly:            true,
 		TargetHeight:          128,
@@ -46,6 +265,7 @@ func TestSomeSites(t *testing.T) {
 }
 
 func TestSomeSitesWithSVG(t *testing.T) {
+	skipUnlessLive(t)
 	config := Config{
 		SquareOnly:            true,
 		TargetHeight:          32,
@@ -85,3 +305,361 @@ func TestSomeSitesWithSVG(t *testing.T) {
 		t.Error("didn't find icon for pkg.go.dev", ok, icon)
 	}
 }
+
+func TestGetIconsContextCancelled(t *testing.T) {
+	config := Config{
+		SquareOnly:            true,
+		TargetHeight:          128,
+		MaxConcurrentRequests: 4,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	icons, err := GetIconsContext(ctx, config, []string{"google.com", "example.com", "gov.uk"})
+	if !errors.Is(err, context.Canceled) {
+		t.Error("expected context.Canceled, got", err)
+	}
+	if len(icons) != 0 {
+		t.Error("expected no icons, got", icons)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("cancelled scrape took", elapsed)
+	}
+}
+
+func TestStreamIconsSendsEveryDomain(t *testing.T) {
+	release := make(chan struct{})
+	slowPage := htmlPage(`<link rel="icon" href="/icon.png">`)
+	slowPage.release = release
+	config := Config{
+		SquareOnly:            true,
+		TargetHeight:          128,
+		MaxConcurrentRequests: 4,
+		HTTPClient: newTestClient(t, map[string]testSite{
+			"slow.test": {"/": slowPage, "/icon.png": pngImage(128, 128)},
+			"fast.test": {"/": htmlPage(`<link rel="icon" href="/icon.png">`), "/icon.png": pngImage(128, 128)},
+		}),
+	}
+
+	// The fast domain's result is sent as soon as it's ready, without waiting for the slow domain.
+	results := StreamIcons(context.Background(), config, []string{"slow.test", "fast.test"})
+	var first Result
+	select {
+	case first = <-results:
+	case <-time.After(10 * time.Second):
+	}
+	close(release)
+	if first.Domain != "fast.test" || first.Icon == nil {
+		t.Error("expected the fast domain's icon first, got", first.Domain, first.Icon)
+	}
+	if res, ok := <-results; !ok || res.Domain != "slow.test" || res.Icon == nil {
+		t.Error("expected the slow domain's icon once released, got", res.Domain, res.Icon)
+	}
+	if _, ok := <-results; ok {
+		t.Error("expected the results to end")
+	}
+
+	// Once the context is cancelled, every domain still gets a result.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	domains := []string{"google.com", "example.com", "not a domain"}
+	seen := make(map[string]int)
+	for res := range StreamIcons(ctx, config, domains) {
+		seen[res.Domain]++
+	}
+	for _, domain := range domains {
+		if seen[domain] != 1 {
+			t.Error("expected exactly one result for", domain, "got", seen[domain])
+		}
+	}
+}
+
+func TestDomainTimeout(t *testing.T) {
+	config := Config{
+		TargetHeight:          128,
+		MaxConcurrentRequests: 4,
+		HTTPClient:            newTestClient(t, testSites),
+		DomainTimeout:         200 * time.Millisecond,
+		Errors:                make(chan error, 16),
+		Warnings:              make(chan error, 16),
+	}
+	start := time.Now()
+	icon := GetIcon(config, "slow.test")
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Error("domain timeout not enforced, took", elapsed)
+	}
+	if icon == nil || icon.URL != "https://slow.test/fast.png" {
+		t.Error("expected the fast icon, got", icon)
+	}
+	select {
+	case err := <-config.Errors:
+		if !strings.Contains(err.Error(), "Ran out of time") {
+			t.Error("unexpected error", err)
+		}
+	default:
+		t.Error("expected a timeout error")
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	config := Config{
+		TargetHeight:          128,
+		MaxConcurrentRequests: 4,
+		HTTPClient:            newTestClient(t, testSites),
+		MaxImageBytes:         4096,
+		MaxImageDimension:     256,
+		Errors:                make(chan error, 16),
+		Warnings:              make(chan error, 16),
+	}
+	icon := GetIcon(config, "large.test")
+	if icon == nil || icon.URL != "https://large.test/ok.png" {
+		t.Error("expected the small icon, got", icon)
+	}
+	close(config.Warnings)
+	var tooLarge *ResponseTooLargeError
+	var imageTooLarge *ImageTooLargeError
+	for warning := range config.Warnings {
+		if errors.As(warning, &tooLarge) && tooLarge.URL != "https://large.test/huge.png" {
+			t.Error("unexpected URL", tooLarge.URL)
+		}
+		if errors.As(warning, &imageTooLarge) && (imageTooLarge.URL != "https://large.test/wide.png" || imageTooLarge.Width != 300) {
+			t.Error("unexpected image", imageTooLarge)
+		}
+	}
+	if tooLarge == nil || imageTooLarge == nil {
+		t.Error("expected both size warnings", tooLarge, imageTooLarge)
+	}
+}
+
+func TestScraperResultCache(t *testing.T) {
+	server := newTestServer(t, testSites)
+	clock := newFakeClock()
+	scraper := NewScraper(Config{
+		TargetHeight:           128,
+		MaxConcurrentRequests:  4,
+		HTTPClient:             &http.Client{Transport: server.transport()},
+		ResultCacheSize:        2,
+		ResultCacheTTL:         time.Hour,
+		NegativeResultCacheTTL: time.Minute,
+		Clock:                  clock,
+		Errors:                 make(chan error, 64),
+		Warnings:               make(chan error, 64),
+	})
+	defer scraper.Close()
+
+	ctx := context.Background()
+	lookup := func(domain string, expectedRequests int64) *Icon {
+		t.Helper()
+		atomic.StoreInt64(&server.requests, 0)
+		icon, err := scraper.GetIcon(ctx, domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if requests := atomic.LoadInt64(&server.requests); requests != expectedRequests {
+			t.Error("expected", expectedRequests, "requests for", domain, "got", requests)
+		}
+		return icon
+	}
+
+	if icon := lookup("icons.test", 7); icon == nil || icon.ImageConfig.Height != 144 {
+		t.Fatal("expected the 144px icon, got", icon)
+	}
+	if icon := lookup("icons.test", 0); icon == nil || icon.ImageConfig.Height != 144 {
+		t.Error("expected the cached 144px icon, got", icon)
+	}
+	if icon := lookup("empty.test", 2); icon != nil {
+		t.Error("found icon for empty.test", icon.URL)
+	}
+	lookup("empty.test", 0)
+
+	// The negative entry expires first.
+	clock.After(2 * time.Minute)
+	lookup("empty.test", 2)
+	lookup("icons.test", 0)
+
+	// Adding a third domain evicts the least recently used.
+	lookup("svg.test", 4)
+	lookup("icons.test", 0)
+	lookup("empty.test", 2)
+}
+
+func TestScraperResultCacheTimeout(t *testing.T) {
+	server := newTestServer(t, testSites)
+	scraper := NewScraper(Config{
+		TargetHeight:          128,
+		MaxConcurrentRequests: 4,
+		HTTPClient:            &http.Client{Transport: server.transport()},
+		DomainTimeout:         200 * time.Millisecond,
+		ResultCacheSize:       2,
+		Errors:                make(chan error, 16),
+		Warnings:              make(chan error, 16),
+	})
+	defer scraper.Close()
+
+	// A result cut short by the domain timeout isn't cached, so the domain is scraped again.
+	for attempt := 0; attempt < 2; attempt++ {
+		atomic.StoreInt64(&server.requests, 0)
+		icon, err := scraper.GetIcon(context.Background(), "slow.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if icon == nil || icon.URL != "https://slow.test/fast.png" {
+			t.Error("expected the fast icon, got", icon)
+		}
+		if requests := atomic.LoadInt64(&server.requests); requests == 0 {
+			t.Error("expected attempt", attempt, "to make requests")
+		}
+	}
+}
+
+func TestDuplicateIconsFetchedOnce(t *testing.T) {
+	server := newTestServer(t, map[string]testSite{
+		"dupes.test": {
+			"/":            htmlPage(`<link rel="icon" href="/favicon.ico"><link rel="shortcut icon" href="https://DUPES.test/favicon.ico"><link rel="apple-touch-icon" href="/icon.png"><meta itemprop="image" content="/icon.png">`),
+			"/favicon.ico": pngImage(16, 16),
+			"/icon.png":    pngImage(180, 180),
+		},
+	})
+	config := Config{
+		TargetHeight:          128,
+		MaxConcurrentRequests: 4,
+		HTTPClient:            &http.Client{Transport: server.transport()},
+	}
+	if icon := GetIcon(config, "dupes.test"); icon == nil || icon.ImageConfig.Height != 180 {
+		t.Error("expected the 180px icon, got", icon)
+	}
+	if server.requests != 3 {
+		t.Error("expected 3 requests, got", server.requests)
+	}
+}
+
+func TestGetCandidates(t *testing.T) {
+	server := newTestServer(t, testSites)
+	config := Config{
+		SquareOnly:            true,
+		TargetHeight:          128,
+		MaxConcurrentRequests: 4,
+		HTTPClient:            &http.Client{Transport: server.transport()},
+	}
+	candidates, err := GetCandidates(context.Background(), config, "icons.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var heights []int
+	for _, icon := range candidates {
+		heights = append(heights, icon.ImageConfig.Height)
+	}
+	if fmt.Sprint(heights) != "[512 180 144 32 16]" {
+		t.Error("expected every icon, largest first, got", heights)
+	}
+
+	candidates, err = GetCandidates(context.Background(), config, "svg.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 2 || candidates[0].Type != svgMimeType {
+		t.Error("expected the SVG first, got", candidates)
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	server := newTestServer(t, testSites)
+	config := Config{
+		MaxConcurrentRequests: 4,
+		HTTPClient:            &http.Client{Transport: server.transport()},
+	}
+	candidates, err := GetCandidates(context.Background(), config, "icons.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provenances := make(map[string]Provenance)
+	for _, icon := range candidates {
+		provenances[icon.URL] = icon.Provenance
+	}
+	expected := map[string]Provenance{
+		"https://icons.test/favicon.ico": {Kind: SourceFavicon},
+		"https://icons.test/icon-32.png": {
+			Kind:      SourceLink,
+			Attribute: "icon",
+			Sizes:     "32x32",
+			Type:      "image/png",
+			Referrer:  "https://icons.test",
+		},
+		"https://icons.test/icon-180.png": {Kind: SourceLink, Attribute: "apple-touch-icon", Referrer: "https://icons.test"},
+		"https://icons.test/icon-144.png": {
+			Kind:     SourceManifest,
+			Sizes:    "144x144",
+			Purpose:  "any",
+			Referrer: "https://icons.test/manifest.json",
+		},
+		"https://cdn.test/icon-512.png": {Kind: SourceManifest, Referrer: "https://icons.test/manifest.json"},
+	}
+	for url, provenance := range expected {
+		if provenances[url] != provenance {
+			t.Errorf("expected %s provenance %+v, got %+v", url, provenance, provenances[url])
+		}
+	}
+
+	// A linked favicon.ico records the link.
+	server = newTestServer(t, map[string]testSite{
+		"linked.test": {
+			"/":            htmlPage(`<link rel="shortcut icon" href="/favicon.ico">`),
+			"/favicon.ico": pngImage(16, 16),
+		},
+	})
+	config.HTTPClient = &http.Client{Transport: server.transport()}
+	if icon := GetIcon(config, "linked.test"); icon == nil || icon.Provenance.Kind != SourceLink || icon.Provenance.Attribute != "shortcut icon" {
+		t.Error("expected the favicon from the link, got", icon)
+	}
+
+	// The page's links take precedence over a manifest linked before them, which takes precedence
+	// over the favicon check.
+	server = newTestServer(t, map[string]testSite{
+		"order.test": {
+			"/":              htmlPage(`<link rel="manifest" href="/manifest.json"><link rel="icon" href="/icon.png">`),
+			"/manifest.json": {body: []byte(`{"icons": [{"src": "/icon.png"}, {"src": "/favicon.ico", "sizes": "16x16"}]}`)},
+			"/icon.png":      pngImage(32, 32),
+			"/favicon.ico":   pngImage(16, 16),
+		},
+	})
+	config.HTTPClient = &http.Client{Transport: server.transport()}
+	candidates, err = GetCandidates(context.Background(), config, "order.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string]SourceKind)
+	for _, icon := range candidates {
+		kinds[icon.URL] = icon.Provenance.Kind
+	}
+	if kinds["https://order.test/icon.png"] != SourceLink || kinds["https://order.test/favicon.ico"] != SourceManifest {
+		t.Error("expected the link and manifest provenances, got", kinds)
+	}
+}
+
+func TestGetIconSets(t *testing.T) {
+	server := newTestServer(t, testSites)
+	config := Config{
+		SquareOnly:            true,
+		MaxConcurrentRequests: 4,
+		HTTPClient:            &http.Client{Transport: server.transport()},
+		Targets:               []Target{{Height: 16}, {Height: 32}, {Height: 64}, {Width: 180, Height: 180}, {Height: 1024}},
+	}
+	sets, err := GetIconSets(context.Background(), config, []string{"icons.test", "empty.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 1 {
+		t.Error("expected only a set for icons.test, got", sets)
+	}
+	expected := map[Target]int{{Height: 16}: 16, {Height: 32}: 32, {Height: 64}: 144, {Width: 180, Height: 180}: 180, {Height: 1024}: 512}
+	for target, height := range expected {
+		if icon, ok := sets["icons.test"][target]; !ok || icon.ImageConfig.Height != height {
+			t.Error("expected", height, "icon for", target, "got", ok, icon.URL)
+		}
+	}
+	// Every size was selected from a single scrape: 7 requests for icons.test and 2 for empty.test.
+	if server.requests != 9 {
+		t.Error("expected 9 requests, got", server.requests)
+	}
+}
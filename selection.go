@@ -0,0 +1,368 @@
+package iconscraper
+
+import (
+	"context"
+	"image"
+	"math"
+)
+
+// Selector chooses the icon to return for a domain.
+//
+// Candidates are sorted with SVGs first, then from tallest to shortest, as returned by
+// GetCandidates. Select should respect the constraints in config, such as AllowSvg and the size
+// bounds; the built-in selectors do so using Acceptable.
+type Selector interface {
+	// Select returns the best of the candidates, or nil if none are acceptable.
+	Select(config Config, candidates []Icon) *Icon
+}
+
+// SelectorFunc is an adapter allowing an ordinary function to be used as a Selector.
+type SelectorFunc func(config Config, candidates []Icon) *Icon
+
+// Select calls f(config, candidates).
+func (f SelectorFunc) Select(config Config, candidates []Icon) *Icon {
+	return f(config, candidates)
+}
+
+// Acceptable returns true if the icon may be selected under the config: it's not an SVG unless
+// AllowSvg is set, it has the aspect ratio required and, for non-vector images, it's within the size
+// bounds. SVGs without a known size are assumed to have any aspect ratio required.
+func Acceptable(config Config, icon *Icon) bool {
+	width, height := icon.ImageConfig.Width, icon.ImageConfig.Height
+	if icon.Type == svgMimeType {
+		if !config.AllowSvg {
+			return false
+		}
+		if width == 0 || height == 0 {
+			return true
+		}
+	} else if width < config.MinWidth || height < config.MinHeight ||
+		(config.MaxWidth != 0 && width > config.MaxWidth) ||
+		(config.MaxHeight != 0 && height > config.MaxHeight) {
+		return false
+	}
+
+	ratio := aspectRatio(config)
+	if ratio == 0 {
+		return true
+	}
+	if config.AspectRatioTolerance == 0 {
+		// Compare exactly, without rounding errors.
+		return float64(width) == ratio*float64(height)
+	}
+	if height == 0 {
+		return false
+	}
+	return aspectError(ratio, icon) <= config.AspectRatioTolerance
+}
+
+// aspectRatio returns the aspect ratio required by config, or 0 if any is allowed.
+func aspectRatio(config Config) float64 {
+	if config.SquareOnly {
+		return 1
+	}
+	return config.AspectRatio
+}
+
+// aspectError returns how far the aspect ratio of the icon, which must have a height, is from ratio,
+// as a fraction of it.
+func aspectError(ratio float64, icon *Icon) float64 {
+	return math.Abs(float64(icon.ImageConfig.Width)/float64(icon.ImageConfig.Height)/ratio - 1)
+}
+
+// bestSvg returns the acceptable SVG whose shape best matches the aspect ratio required by config,
+// or is closest to square if any is allowed. SVGs without a known size come last. Ties are broken
+// by the order of the candidates, so the SVG with the largest nominal size wins.
+func bestSvg(config Config, candidates []Icon) *Icon {
+	ratio := aspectRatio(config)
+	if ratio == 0 {
+		ratio = 1
+	}
+	var best *Icon
+	bestMismatch := math.Inf(1)
+	for idx := range candidates {
+		image := &candidates[idx]
+		if image.Type != svgMimeType || !Acceptable(config, image) {
+			continue
+		}
+		mismatch := math.MaxFloat64
+		if image.ImageConfig.Width != 0 && image.ImageConfig.Height != 0 {
+			mismatch = aspectError(ratio, image)
+		}
+		if mismatch < bestMismatch {
+			best, bestMismatch = image, mismatch
+		}
+	}
+	return best
+}
+
+// meetsTarget returns true if the image is at least config.TargetHeight tall and config.TargetWidth
+// wide.
+func meetsTarget(config Config, icon *Icon) bool {
+	return icon.ImageConfig.Height >= config.TargetHeight && icon.ImageConfig.Width >= config.TargetWidth
+}
+
+// smaller returns true if a is shorter than b or, if they're the same height, narrower.
+func smaller(a, b *Icon) bool {
+	if a.ImageConfig.Height != b.ImageConfig.Height {
+		return a.ImageConfig.Height < b.ImageConfig.Height
+	}
+	return a.ImageConfig.Width < b.ImageConfig.Width
+}
+
+// DefaultSelector is the selector used if Config.Selector is nil.
+//
+// An SVG is always chosen if one is allowed, as chosen by bestSvg. Otherwise, it chooses the
+// smallest image meeting the target (at least config.TargetHeight tall and config.TargetWidth wide)
+// or, if there isn't one, the largest image.
+type DefaultSelector struct{}
+
+func (DefaultSelector) Select(config Config, candidates []Icon) *Icon {
+	// Always prefer SVG icons
+	if svg := bestSvg(config, candidates); svg != nil {
+		return svg
+	}
+
+	// Track the largest image
+	var largestImage *Icon
+	// Track the smallest image meeting the target
+	var smallestOkImage *Icon
+
+	for idx := range candidates {
+		image := &candidates[idx]
+		if image.Type == svgMimeType || !Acceptable(config, image) {
+			continue
+		}
+
+		// Update `smallestOkImage`
+		if meetsTarget(config, image) {
+			if smallestOkImage == nil || smaller(image, smallestOkImage) {
+				smallestOkImage = image
+			}
+		}
+
+		// Update `largestImage`
+		if largestImage == nil || smaller(largestImage, image) {
+			largestImage = image
+		}
+	}
+
+	if smallestOkImage != nil {
+		return smallestOkImage
+	}
+	return largestImage
+}
+
+// ClosestSelector chooses the image whose height is closest to config.TargetHeight, preferring the
+// larger image of two equally close. If config.TargetWidth is set, the difference in width is added
+// to the difference in height. An SVG is always chosen if one is allowed.
+type ClosestSelector struct{}
+
+func (ClosestSelector) Select(config Config, candidates []Icon) *Icon {
+	if svg := bestSvg(config, candidates); svg != nil {
+		return svg
+	}
+	var best *Icon
+	bestDiff := 0
+	for idx := range candidates {
+		image := &candidates[idx]
+		if image.Type == svgMimeType || !Acceptable(config, image) {
+			continue
+		}
+		diff := abs(image.ImageConfig.Height - config.TargetHeight)
+		if config.TargetWidth != 0 {
+			diff += abs(image.ImageConfig.Width - config.TargetWidth)
+		}
+		// Candidates are sorted largest first, so the first of equally close images is the largest.
+		if best == nil || diff < bestDiff {
+			best, bestDiff = image, diff
+		}
+	}
+	return best
+}
+
+// LargestSelector chooses the tallest image, or the widest of those equally tall, ignoring the
+// target size. An SVG is always chosen if one is allowed.
+type LargestSelector struct{}
+
+func (LargestSelector) Select(config Config, candidates []Icon) *Icon {
+	if svg := bestSvg(config, candidates); svg != nil {
+		return svg
+	}
+	var best *Icon
+	for idx := range candidates {
+		image := &candidates[idx]
+		if image.Type == svgMimeType || !Acceptable(config, image) {
+			continue
+		}
+		if best == nil || smaller(best, image) {
+			best = image
+		}
+	}
+	return best
+}
+
+// PreferSourceSelector prefers icons found from particular kinds of reference, for example to
+// favour the icons declared in a web app manifest.
+//
+// The candidates from each of Kinds are tried in turn, choosing between them with Fallback. If none
+// of them are acceptable, Fallback chooses from all the candidates.
+type PreferSourceSelector struct {
+	// Kinds of reference to prefer, most preferred first.
+	Kinds []SourceKind
+
+	// Fallback is used to choose between candidates. If nil, DefaultSelector is used.
+	Fallback Selector
+}
+
+func (selector PreferSourceSelector) Select(config Config, candidates []Icon) *Icon {
+	fallback := selector.Fallback
+	if fallback == nil {
+		fallback = DefaultSelector{}
+	}
+	for _, kind := range selector.Kinds {
+		var fromKind []Icon
+		for _, icon := range candidates {
+			if icon.Provenance.Kind == kind {
+				fromKind = append(fromKind, icon)
+			}
+		}
+		if best := fallback.Select(config, fromKind); best != nil {
+			return best
+		}
+	}
+	return fallback.Select(config, candidates)
+}
+
+// Target is a size an icon is wanted for, in pixels. Zero means any width or height.
+type Target struct {
+	Width, Height int
+}
+
+// IconSet holds the icon selected for each target. Targets without an acceptable icon are omitted.
+type IconSet map[Target]Icon
+
+// pickIconSet picks the best image for each of config.Targets, as selectIcon does for
+// config.TargetWidth and config.TargetHeight. Targets which pick the same image, and finish it the
+// same way, share it, rather than finishing it again.
+func pickIconSet(ctx context.Context, config Config, images []Icon, finished map[finishKey]*Icon) IconSet {
+	set := make(IconSet, len(config.Targets))
+	for _, target := range config.Targets {
+		targetConfig := config
+		targetConfig.TargetWidth, targetConfig.TargetHeight = target.Width, target.Height
+		if icon := selectIcon(ctx, targetConfig, images, finished); icon != nil {
+			set[target] = *icon
+		}
+	}
+	return set
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// selectIcon picks the best image, as pickBestImage does, and finishes it with finishIcon. If there
+// isn't one, and config.PadToSquare and config.SquareOnly are set, the best image of any shape is
+// picked to be padded instead, unless it can't be padded. If there are no images, returns `nil`.
+//
+// Icons already finished the same way are taken from finished, which may be nil, and those newly
+// finished are added to it.
+func selectIcon(ctx context.Context, config Config, images []Icon, finished map[finishKey]*Icon) *Icon {
+	if icon := finishBestImage(ctx, config, config, images, false, finished); icon != nil {
+		return icon
+	}
+	if config.PadToSquare && config.SquareOnly {
+		relaxed := config
+		relaxed.SquareOnly = false
+		relaxed.AspectRatio = 0
+		// Without the padded output, the icon isn't square, so can't be used.
+		if icon := finishBestImage(ctx, config, relaxed, images, true, finished); icon != nil && icon.Output != nil {
+			return icon
+		}
+	}
+	return nil
+}
+
+// finishBestImage picks the best image using the pick config, and finishes it using config. If
+// it's an SVG which should be, but couldn't be, rasterized, the next best image is used instead.
+func finishBestImage(
+	ctx context.Context,
+	config, pick Config,
+	images []Icon,
+	padded bool,
+	finished map[finishKey]*Icon,
+) *Icon {
+	for {
+		best := pickBestImage(pick, images)
+		if best == nil {
+			return nil
+		}
+		key := newFinishKey(config, best, padded)
+		icon, ok := finished[key]
+		if !ok {
+			icon = finishIcon(ctx, config, best, padded)
+			if finished != nil {
+				finished[key] = icon
+			}
+		}
+		if icon.Raster != nil || !config.RasterizeSvg || icon.Type != svgMimeType || ctx.Err() != nil {
+			return icon
+		}
+		var remaining []Icon
+		for _, candidate := range images {
+			if candidate.URL != best.URL {
+				remaining = append(remaining, candidate)
+			}
+		}
+		if len(remaining) == len(images) {
+			return icon
+		}
+		images = remaining
+	}
+}
+
+// finishKey identifies an image and how it's finished by finishIcon, so that it's only finished
+// once for each way it's needed.
+type finishKey struct {
+	url    string
+	padded bool
+	// raster is the size an SVG is rasterized at, if it is.
+	raster image.Point
+	// output is the size of the output icon, if there is one and it's known before finishing.
+	output image.Point
+	// target is the target size for trimmed icons, whose output size depends on their content.
+	target Target
+}
+
+// newFinishKey returns the key for finishing icon with config.
+func newFinishKey(config Config, icon *Icon, padded bool) finishKey {
+	key := finishKey{url: icon.URL, padded: padded}
+	if config.RasterizeSvg && icon.Type == svgMimeType {
+		width, height := rasterSize(config, icon.ImageConfig)
+		key.raster = image.Pt(width, height)
+	}
+	switch {
+	case config.TrimBorders:
+		key.target = Target{Width: config.TargetWidth, Height: config.TargetHeight}
+	case padded:
+		side := squareSize(config, icon.ImageConfig)
+		key.output = image.Pt(side, side)
+	case config.Resize:
+		width, height := outputSize(config, icon.ImageConfig)
+		key.output = image.Pt(width, height)
+	}
+	return key
+}
+
+// pickBestImage picks the image from the given list using config.Selector, or DefaultSelector if
+// it's not set. If there are no acceptable images, returns `nil`.
+func pickBestImage(config Config, images []Icon) *Icon {
+	selector := config.Selector
+	if selector == nil {
+		selector = DefaultSelector{}
+	}
+	return selector.Select(config, images)
+}
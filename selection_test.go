@@ -0,0 +1,122 @@
+package iconscraper
+
+import (
+	"context"
+	"image"
+	"testing"
+)
+
+func TestSelectors(t *testing.T) {
+	candidate := func(url string, width, height int, kind SourceKind) Icon {
+		return Icon{
+			URL:         url,
+			Type:        "image/png",
+			ImageConfig: image.Config{Width: width, Height: height},
+			Provenance:  Provenance{Kind: kind},
+		}
+	}
+	candidates := []Icon{
+		{URL: "logo.svg", Type: svgMimeType, Provenance: Provenance{Kind: SourceLink}},
+		candidate("wide", 400, 200, SourceMeta),
+		candidate("192", 192, 192, SourceManifest),
+		candidate("180", 180, 180, SourceLink),
+		candidate("120", 120, 120, SourceLink),
+		candidate("16", 16, 16, SourceFavicon),
+	}
+	sortCandidates(candidates)
+
+	tests := []struct {
+		name     string
+		selector Selector
+		config   Config
+		expected string
+	}{
+		{"default", nil, Config{TargetHeight: 128}, "180"},
+		{"default svg", DefaultSelector{}, Config{TargetHeight: 128, AllowSvg: true}, "logo.svg"},
+		{"default too small", DefaultSelector{}, Config{TargetHeight: 1024}, "wide"},
+		{"default square", DefaultSelector{}, Config{TargetHeight: 1024, SquareOnly: true}, "192"},
+		{"closest", ClosestSelector{}, Config{TargetHeight: 128}, "120"},
+		{"closest tie", ClosestSelector{}, Config{TargetHeight: 186}, "192"},
+		{"largest", LargestSelector{}, Config{SquareOnly: true}, "192"},
+		{"prefer favicon", PreferSourceSelector{Kinds: []SourceKind{SourceFavicon}}, Config{TargetHeight: 128}, "16"},
+		{"prefer manifest", PreferSourceSelector{Kinds: []SourceKind{SourceManifest, SourceLink}, Fallback: ClosestSelector{}}, Config{TargetHeight: 128}, "192"},
+		{"prefer missing", PreferSourceSelector{Kinds: []SourceKind{SourceMeta}}, Config{TargetHeight: 128, SquareOnly: true}, "180"},
+		{"func", SelectorFunc(func(Config, []Icon) *Icon { return nil }), Config{}, ""},
+	}
+	for _, test := range tests {
+		test.config.Selector = test.selector
+		best := pickBestImage(test.config, candidates)
+		url := ""
+		if best != nil {
+			url = best.URL
+		}
+		if url != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, url)
+		}
+	}
+}
+
+func TestSizeConstraints(t *testing.T) {
+	candidates := []Icon{
+		{URL: "wide", ImageConfig: image.Config{Width: 400, Height: 100}},
+		{URL: "logo", ImageConfig: image.Config{Width: 300, Height: 100}},
+		{URL: "181", ImageConfig: image.Config{Width: 180, Height: 181}},
+		{URL: "150", ImageConfig: image.Config{Width: 150, Height: 150}},
+		{URL: "16", ImageConfig: image.Config{Width: 16, Height: 16}},
+	}
+	sortCandidates(candidates)
+
+	tests := []struct {
+		name     string
+		config   Config
+		expected string
+	}{
+		{"square", Config{TargetHeight: 160, SquareOnly: true}, "150"},
+		{"nearly square", Config{TargetHeight: 160, SquareOnly: true, AspectRatioTolerance: 0.01}, "181"},
+		{"target width", Config{TargetHeight: 90, TargetWidth: 350}, "wide"},
+		{"target width too large", Config{TargetWidth: 500}, "181"},
+		{"aspect ratio", Config{AspectRatio: 3}, "logo"},
+		{"aspect ratio tolerance", Config{TargetWidth: 350, AspectRatio: 3, AspectRatioTolerance: 0.4}, "wide"},
+		{"min", Config{MinWidth: 20, MinHeight: 20, SquareOnly: true}, "150"},
+		{"max", Config{TargetHeight: 128, MaxHeight: 160}, "150"},
+		{"max width", Config{TargetHeight: 128, MaxWidth: 160, MaxHeight: 160}, "150"},
+		{"none", Config{MinHeight: 200}, ""},
+	}
+	for _, test := range tests {
+		best := pickBestImage(test.config, candidates)
+		url := ""
+		if best != nil {
+			url = best.URL
+		}
+		if url != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, url)
+		}
+	}
+}
+
+func TestPickIconSetFinishesOnce(t *testing.T) {
+	png := Icon{
+		URL:         "icon.png",
+		Type:        "image/png",
+		ImageConfig: image.Config{Width: 64, Height: 64},
+		Source:      pngImage(64, 64).body,
+	}
+	config := Config{
+		Resize:   true,
+		Targets:  []Target{{Height: 32}, {Width: 32}, {Width: 32, Height: 32}, {Height: 48}},
+		Warnings: make(chan error, 4),
+	}
+	set := pickIconSet(context.Background(), config, []Icon{png}, make(map[finishKey]*Icon))
+	for target, size := range map[Target]int{{Height: 32}: 32, {Width: 32}: 32, {Width: 32, Height: 32}: 32, {Height: 48}: 48} {
+		if output := set[target].Output; output == nil || output.ImageConfig.Width != size || output.ImageConfig.Height != size {
+			t.Fatal("expected a", size, "pixel output for", target, "got", output)
+		}
+	}
+	// The targets with the same output size share a single output.
+	if set[Target{Height: 32}].Output != set[Target{Width: 32}].Output || set[Target{Width: 32}].Output != set[Target{Width: 32, Height: 32}].Output {
+		t.Error("expected the 32 pixel targets to share their output")
+	}
+	if set[Target{Height: 32}].Output == set[Target{Height: 48}].Output {
+		t.Error("expected the 48 pixel target to have its own output")
+	}
+}
@@ -0,0 +1,153 @@
+package iconscraper
+
+import (
+	"bytes"
+	"encoding/xml"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// svgUnits are the sizes of the absolute CSS units, in pixels. Font relative units assume the
+// default font size of 16 pixels.
+var svgUnits = map[string]float64{
+	"":   1,
+	"px": 1,
+	"pt": 4.0 / 3,
+	"pc": 16,
+	"in": 96,
+	"cm": 96 / 2.54,
+	"mm": 96 / 25.4,
+	"q":  96 / 101.6,
+	"em": 16,
+	"ex": 8,
+}
+
+// svgRoot returns the root element of an SVG image, or false if the root element isn't an svg
+// element.
+func svgRoot(data []byte) (xml.StartElement, bool) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return xml.StartElement{}, false
+		}
+		if root, ok := token.(xml.StartElement); ok {
+			return root, root.Name.Local == "svg"
+		}
+	}
+}
+
+// svgSize returns the nominal size of an SVG image, in pixels, from the width, height and viewBox
+// of its root element.
+//
+// If the width or height isn't set, or is relative (a percentage), it's calculated from the
+// viewBox, using the aspect ratio of the viewBox if the other is set. If the size can't be
+// determined, false is returned.
+func svgSize(data []byte) (width, height float64, ok bool) {
+	root, ok := svgRoot(data)
+	if !ok {
+		return 0, 0, false
+	}
+	return svgRootSize(root)
+}
+
+// svgRootSize is svgSize for an already parsed root element.
+func svgRootSize(root xml.StartElement) (width, height float64, ok bool) {
+	for _, attr := range root.Attr {
+		switch attr.Name.Local {
+		case "width":
+			width = parseSvgLength(attr.Value)
+		case "height":
+			height = parseSvgLength(attr.Value)
+		}
+	}
+
+	viewBox, hasViewBox := svgViewBox(root)
+	viewBoxWidth, viewBoxHeight := viewBox[2], viewBox[3]
+	switch {
+	case width > 0 && height > 0:
+	case width > 0 && hasViewBox:
+		height = width * viewBoxHeight / viewBoxWidth
+	case height > 0 && hasViewBox:
+		width = height * viewBoxWidth / viewBoxHeight
+	case hasViewBox:
+		width, height = viewBoxWidth, viewBoxHeight
+	default:
+		return 0, 0, false
+	}
+	return width, height, true
+}
+
+// svgViewBox returns the viewBox of the root element, as min-x, min-y, width and height, or false if
+// it doesn't have a valid viewBox.
+func svgViewBox(root xml.StartElement) ([4]float64, bool) {
+	var viewBox [4]float64
+	for _, attr := range root.Attr {
+		if attr.Name.Local != "viewBox" {
+			continue
+		}
+		numbers := parseSvgNumbers(attr.Value)
+		if len(numbers) != 4 || numbers[2] <= 0 || numbers[3] <= 0 {
+			return viewBox, false
+		}
+		copy(viewBox[:], numbers)
+		return viewBox, true
+	}
+	return viewBox, false
+}
+
+// parseSvgNumber parses a number, which may have an absolute CSS unit, returning it in pixels, or
+// false if it's invalid or relative.
+func parseSvgNumber(value string) (float64, bool) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	end := len(value)
+	for end > 0 && value[end-1] >= 'a' && value[end-1] <= 'z' {
+		end--
+	}
+	unit, ok := svgUnits[value[end:]]
+	if !ok {
+		return 0, false
+	}
+	number, err := strconv.ParseFloat(value[:end], 64)
+	if err != nil || math.IsInf(number, 0) || math.IsNaN(number) {
+		return 0, false
+	}
+	return number * unit, true
+}
+
+// parseSvgLength parses an absolute CSS length, returning it in pixels, or 0 if it's invalid,
+// relative or not positive.
+func parseSvgLength(value string) float64 {
+	length, ok := parseSvgNumber(value)
+	if !ok || length <= 0 {
+		return 0
+	}
+	return length
+}
+
+// svgConfig returns the image config of an SVG image, with its nominal size rounded to whole
+// pixels, or a zero config if its size can't be determined.
+func svgConfig(data []byte) image.Config {
+	width, height, ok := svgSize(data)
+	if !ok {
+		return image.Config{}
+	}
+	return image.Config{
+		Width:  roundDimension(width),
+		Height: roundDimension(height),
+	}
+}
+
+// roundDimension rounds a positive length to a whole number of pixels, which is at least 1.
+func roundDimension(length float64) int {
+	if length > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	if length < 1 {
+		return 1
+	}
+	return int(math.Round(length))
+}
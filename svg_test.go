@@ -0,0 +1,68 @@
+package iconscraper
+
+import (
+	"image"
+	"testing"
+)
+
+func TestSvgSize(t *testing.T) {
+	tests := []struct {
+		svg           string
+		width, height float64
+		ok            bool
+	}{
+		{`<svg xmlns="http://www.w3.org/2000/svg" width="32" height="16"/>`, 32, 16, true},
+		{`<?xml version="1.0"?><!-- logo --><svg viewBox="0 0 24 24"></svg>`, 24, 24, true},
+		{`<svg viewBox="0,0,300,100" width="150"></svg>`, 150, 50, true},
+		{`<svg viewBox="0 0 300 100" height="1in"></svg>`, 288, 96, true},
+		{`<svg viewBox="0 0 300 100" width="100%" height="100%"></svg>`, 300, 100, true},
+		{`<svg width="12pt" height="1.5em"></svg>`, 16, 24, true},
+		{`<svg width="100%" height="100%"></svg>`, 0, 0, false},
+		{`<svg width="10"></svg>`, 0, 0, false},
+		{`<svg viewBox="0 0 0 10"></svg>`, 0, 0, false},
+		{`<html><svg width="10" height="10"></svg></html>`, 0, 0, false},
+		{`not xml`, 0, 0, false},
+	}
+	for _, test := range tests {
+		width, height, ok := svgSize([]byte(test.svg))
+		if width != test.width || height != test.height || ok != test.ok {
+			t.Errorf("%s: expected %vx%v %v, got %vx%v %v", test.svg, test.width, test.height, test.ok, width, height, ok)
+		}
+	}
+}
+
+func TestSvgSelection(t *testing.T) {
+	candidates := []Icon{
+		{URL: "wordmark.svg", Type: svgMimeType, ImageConfig: image.Config{Width: 400, Height: 100}},
+		{URL: "nearly-square.svg", Type: svgMimeType, ImageConfig: image.Config{Width: 49, Height: 48}},
+		{URL: "square.svg", Type: svgMimeType, ImageConfig: image.Config{Width: 24, Height: 24}},
+		{URL: "unknown.svg", Type: svgMimeType},
+		{URL: "icon.png", Type: "image/png", ImageConfig: image.Config{Width: 32, Height: 32}},
+	}
+	sortCandidates(candidates)
+
+	tests := []struct {
+		name     string
+		config   Config
+		expected string
+	}{
+		{"square preferred", Config{AllowSvg: true}, "square.svg"},
+		{"square only", Config{AllowSvg: true, SquareOnly: true}, "square.svg"},
+		{"aspect ratio", Config{AllowSvg: true, AspectRatio: 4}, "wordmark.svg"},
+		{"aspect ratio tolerance", Config{AllowSvg: true, AspectRatio: 1.05, AspectRatioTolerance: 0.1}, "nearly-square.svg"},
+		{"unknown size", Config{AllowSvg: true, AspectRatio: 2}, "unknown.svg"},
+		{"not allowed", Config{}, "icon.png"},
+	}
+	for _, test := range tests {
+		best := pickBestImage(test.config, candidates)
+		if best == nil || best.URL != test.expected {
+			t.Errorf("%s: expected %s, got %v", test.name, test.expected, best)
+		}
+	}
+
+	// A wide SVG isn't chosen when only square icons are wanted.
+	wide := []Icon{candidates[0], candidates[4]}
+	if best := pickBestImage(Config{AllowSvg: true, SquareOnly: true}, wide); best == nil || best.URL != "icon.png" {
+		t.Error("expected the square PNG, got", best)
+	}
+}
@@ -0,0 +1,116 @@
+package iconscraper
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// trimBorders crops the border around img that's transparent, or the same color as its top left
+// pixel, leaving a margin of config.TrimMargin. If the whole image is border, it's returned
+// unchanged.
+func trimBorders(config Config, img image.Image) image.Image {
+	content, border, ok := contentBounds(img, config.TrimTolerance)
+	if !ok {
+		return img
+	}
+	return withMargin(img, content, border, config.TrimMargin)
+}
+
+// trimSvg rasterizes an SVG, as for rasterizeIcon, and trims its borders. If there is a border,
+// it's rendered again at a larger scale, so that the trimmed image is about the size it was first
+// rendered at, rather than being scaled up later.
+func trimSvg(ctx context.Context, config Config, icon *Icon) (image.Image, error) {
+	width, height := rasterSize(config, icon.ImageConfig)
+	img, err := rasterizeSvg(ctx, icon.Source, width, height)
+	if err != nil {
+		return nil, err
+	}
+	content, _, ok := contentBounds(img, config.TrimTolerance)
+	if !ok {
+		return img, nil
+	}
+	scale := math.Min(float64(width)/float64(content.Dx()), float64(height)/float64(content.Dy()))
+	// Don't render it any larger than the limit.
+	limit := float64(maxImageDimension(config))
+	scale = math.Min(scale, math.Min(limit/float64(width), limit/float64(height)))
+	if scale > 1 {
+		img, err = rasterizeSvg(ctx, icon.Source, roundDimension(float64(width)*scale), roundDimension(float64(height)*scale))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return trimBorders(config, img), nil
+}
+
+// contentBounds returns the smallest rectangle containing every pixel of img that isn't part of
+// its border, and the color of the border, taken from the top left pixel.
+//
+// A pixel is part of the border if each of its channels is within tolerance, as a fraction of
+// their range, of the border color. If the border color is (nearly) transparent, only the alpha
+// channel is compared, since the color of transparent pixels isn't seen. ok is false if every
+// pixel is part of the border.
+func contentBounds(img image.Image, tolerance float64) (content image.Rectangle, border color.Color, ok bool) {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return bounds, nil, false
+	}
+	border = img.At(bounds.Min.X, bounds.Min.Y)
+	limit := uint32(math.Max(0, math.Min(tolerance, 1)) * 0xffff)
+	br, bg, bb, ba := border.RGBA()
+	transparent := ba <= limit
+	if transparent {
+		border = color.Transparent
+	}
+	near := func(a, b uint32) bool {
+		if a > b {
+			return a-b <= limit
+		}
+		return b-a <= limit
+	}
+
+	minX, minY, maxX, maxY := bounds.Max.X, bounds.Max.Y, bounds.Min.X, bounds.Min.Y
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if transparent && a <= limit ||
+				!transparent && near(r, br) && near(g, bg) && near(b, bb) && near(a, ba) {
+				continue
+			}
+			if x < minX {
+				minX = x
+			}
+			if x >= maxX {
+				maxX = x + 1
+			}
+			if y < minY {
+				minY = y
+			}
+			maxY = y + 1
+		}
+	}
+	if minX >= maxX {
+		return bounds, border, false
+	}
+	return image.Rect(minX, minY, maxX, maxY), border, true
+}
+
+// withMargin copies the content of img onto a canvas filled with the border color, leaving a
+// margin of the given fraction of its longest side, up to 1, around it.
+func withMargin(img image.Image, content image.Rectangle, border color.Color, margin float64) image.Image {
+	longest := content.Dx()
+	if content.Dy() > longest {
+		longest = content.Dy()
+	}
+	pad := 0
+	if margin > 0 {
+		pad = int(math.Round(math.Min(margin, 1) * float64(longest)))
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, content.Dx()+2*pad, content.Dy()+2*pad))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(border), image.Point{}, draw.Src)
+	draw.Draw(canvas, content.Sub(content.Min).Add(image.Pt(pad, pad)), img, content.Min, draw.Src)
+	return canvas
+}
@@ -0,0 +1,143 @@
+package iconscraper
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+// framedImage returns an image of the given size filled with border, with a red square of the
+// given side in its centre.
+func framedImage(width, height, side int, border color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(border), image.Point{}, draw.Src)
+	content := image.Rect((width-side)/2, (height-side)/2, (width+side)/2, (height+side)/2)
+	draw.Draw(img, content, image.NewUniform(color.RGBA{0xff, 0, 0, 0xff}), image.Point{}, draw.Src)
+	return img
+}
+
+func TestTrimBorders(t *testing.T) {
+	// Noise in a white border, which a tolerance allows for.
+	noisy := framedImage(100, 100, 40, color.White)
+	noisy.Set(3, 90, color.RGBA{0xfa, 0xfc, 0xff, 0xff})
+
+	tests := []struct {
+		name          string
+		img           image.Image
+		margin        float64
+		tolerance     float64
+		width, height int
+		corner        string
+	}{
+		{"transparent", framedImage(100, 80, 40, color.Transparent), 0, 0, 40, 40, "ff0000ff"},
+		{"margin", framedImage(100, 80, 40, color.Transparent), 0.1, 0, 48, 48, "00000000"},
+		{"margin larger than image", framedImage(100, 80, 40, color.Transparent), 0.5, 0, 80, 80, "00000000"},
+		{"white", framedImage(64, 64, 32, color.White), 0.25, 0, 48, 48, "ffffffff"},
+		{"noise", noisy, 0, 0, 67, 61, "ffffffff"},
+		{"noise within tolerance", noisy, 0, 0.05, 40, 40, "ff0000ff"},
+		{"no border", framedImage(40, 40, 40, color.Transparent), 0, 0, 40, 40, "ff0000ff"},
+		{"uniform", framedImage(40, 40, 0, color.White), 0, 0, 40, 40, "ffffffff"},
+	}
+	for _, test := range tests {
+		trimmed := trimBorders(Config{TrimMargin: test.margin, TrimTolerance: test.tolerance}, test.img)
+		bounds := trimmed.Bounds()
+		if bounds.Dx() != test.width || bounds.Dy() != test.height {
+			t.Error(test.name, "expected", test.width, test.height, "got", bounds.Dx(), bounds.Dy())
+			continue
+		}
+		corner := hexColor(color.NRGBAModel.Convert(trimmed.At(bounds.Min.X, bounds.Min.Y)).(color.NRGBA))
+		if corner != test.corner {
+			t.Error(test.name, "expected corner", test.corner, "got", corner)
+		}
+	}
+}
+
+func TestTrimBordersIcons(t *testing.T) {
+	var framed bytes.Buffer
+	png.Encode(&framed, framedImage(100, 100, 50, color.Transparent))
+
+	server := newTestServer(t, map[string]testSite{
+		"framed.test": {
+			"/":            htmlPage(`<link rel="icon" href="/icon.png">`),
+			"/icon.png":    {body: framed.Bytes()},
+			"/favicon.ico": {body: []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24"><rect x="6" y="6" width="12" height="12" fill="red"/></svg>`)},
+		},
+	})
+	config := Config{
+		TrimBorders:           true,
+		MaxConcurrentRequests: 4,
+		HTTPClient:            &http.Client{Transport: server.transport()},
+	}
+
+	tests := []struct {
+		name   string
+		resize bool
+		svg    bool
+		side   int
+	}{
+		{"trimmed", false, false, 50},
+		{"trimmed and resized", true, false, 64},
+		{"svg trimmed and resized", true, true, 64},
+	}
+	for _, test := range tests {
+		config.Resize = test.resize
+		config.TargetHeight = 64
+		config.AllowSvg = test.svg
+		icon := GetIcon(config, "framed.test")
+		if icon == nil || icon.Output == nil {
+			t.Fatal(test.name, "expected an output icon, got", icon)
+		}
+		output := icon.Output
+		if output.ImageConfig.Width != test.side || output.ImageConfig.Height != test.side {
+			t.Error(test.name, "expected", test.side, "got", output.ImageConfig.Width, output.ImageConfig.Height)
+			continue
+		}
+		img, err := png.Decode(bytes.NewReader(output.Source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The content fills the output.
+		for _, point := range []image.Point{{1, 1}, {test.side - 2, test.side - 2}} {
+			if c := hexColor(color.NRGBAModel.Convert(img.At(point.X, point.Y)).(color.NRGBA)); c != "ff0000ff" {
+				t.Error(test.name, "expected red at", point, "got", c)
+			}
+		}
+	}
+}
+
+func TestTrimBordersExactSize(t *testing.T) {
+	// A wide red logo in a transparent square.
+	img := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(img, image.Rect(20, 40, 80, 60), image.NewUniform(color.RGBA{0xff, 0, 0, 0xff}), image.Point{}, draw.Src)
+	var source bytes.Buffer
+	png.Encode(&source, img)
+
+	config := Config{TrimBorders: true, Resize: true, TargetWidth: 64, TargetHeight: 64}
+	icon := Icon{Type: "image/png", Source: source.Bytes(), ImageConfig: image.Config{Width: 100, Height: 100}}
+	output, err := outputIcon(context.Background(), config, &icon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.ImageConfig.Width != 64 || output.ImageConfig.Height != 64 {
+		t.Fatal("expected the exact size, got", output.ImageConfig.Width, output.ImageConfig.Height)
+	}
+	decoded, err := png.Decode(bytes.NewReader(output.Source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The logo keeps its shape, filling the width, centred vertically.
+	expected := map[image.Point]string{
+		{1, 32}: "ff0000ff", {62, 32}: "ff0000ff", {32, 32}: "ff0000ff",
+		{32, 4}: "00000000", {32, 59}: "00000000",
+	}
+	for point, expected := range expected {
+		if c := hexColor(color.NRGBAModel.Convert(decoded.At(point.X, point.Y)).(color.NRGBA)); c != expected {
+			t.Error("expected", expected, "at", point, "got", c)
+		}
+	}
+}